@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With -audit-log every successful change made through the HTTP API, RESP or memcached is recorded
+// as a line of JSON in the file. Values aren't recorded, only their SHA-256 hashes.
+// Once the file grows past -audit-log-size, it is renamed to <file>.1, <file>.2 and so on,
+// and a new one is started. Rotated files are never removed.
+
+type auditRecord struct {
+	Time time.Time `json:"time"`
+	// Remote address of the client
+	Remote string `json:"remote"`
+	// The name of the token, or "anonymous" if authentication is disabled
+	Identity string `json:"identity"`
+	// "http", "resp" or "memcached"
+	Protocol string `json:"protocol"`
+	// "put", "delete" or "incr"
+	Op  string `json:"op"`
+	Key string `json:"key"`
+	// Hex SHA-256 of the new value, as text for int64 values
+	ValueSHA256 string `json:"value_sha256,omitempty"`
+}
+
+type auditLogger struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	f       *os.File
+	size    int64
+}
+
+// The audit log of -audit-log, nil if it is disabled
+var mutationLog *auditLogger
+
+func openAuditLog(path string, maxSize int64) (*auditLogger, error) {
+	a := &auditLogger{path: path, maxSize: maxSize}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLogger) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.f, a.size = f, info.Size()
+	return nil
+}
+
+// record appends the record, rotating the file first if it would grow too large.
+func (a *auditLogger) record(rec auditRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := a.f.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+func (a *auditLogger) rotate() error {
+	files, err := a.rotated()
+	if err != nil {
+		return err
+	}
+	// Older files can be removed by hand, so the newest one is numbered after the last rather than by their count
+	n := 1
+	if len(files) > 0 {
+		n, _ = strconv.Atoi(strings.TrimPrefix(files[len(files)-1], a.path+"."))
+		n++
+	}
+	next := fmt.Sprintf("%s.%d", a.path, n)
+	if _, err := os.Lstat(next); err == nil {
+		return fmt.Errorf("can't rotate the audit log to %s, it exists", next)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := a.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(a.path, next); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+// rotated returns the rotated files, oldest first.
+func (a *auditLogger) rotated() ([]string, error) {
+	matches, err := filepath.Glob(a.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	numbers := make(map[string]int)
+	var files []string
+	for _, name := range matches {
+		if n, err := strconv.Atoi(strings.TrimPrefix(name, a.path+".")); err == nil && n > 0 {
+			numbers[name] = n
+			files = append(files, name)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return numbers[files[i]] < numbers[files[j]]
+	})
+	return files, nil
+}
+
+func (a *auditLogger) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.f.Close()
+}
+
+// auditFilter selects records of a query.
+type auditFilter struct {
+	from, to time.Time
+	key      string
+	prefix   string
+}
+
+func (f auditFilter) match(rec auditRecord) bool {
+	return (f.from.IsZero() || !rec.Time.Before(f.from)) && (f.to.IsZero() || rec.Time.Before(f.to)) &&
+		(f.key == "" || rec.Key == f.key) && strings.HasPrefix(rec.Key, f.prefix)
+}
+
+// query returns up to limit records matching the filter, oldest first.
+func (a *auditLogger) query(filter auditFilter, limit int) ([]auditRecord, error) {
+	a.mu.Lock()
+	files, err := a.rotated()
+	a.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	records := make([]auditRecord, 0)
+	for _, name := range append(files, a.path) {
+		if info, err := os.Stat(name); err == nil && !filter.from.IsZero() && info.ModTime().Before(filter.from) {
+			// All records of the file are older
+			continue
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() && len(records) < limit {
+			var rec auditRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				// The last line can be cut short by a crash
+				continue
+			}
+			if filter.match(rec) {
+				records = append(records, rec)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(records) >= limit {
+			break
+		}
+	}
+	return records, nil
+}
+
+func valueHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// auditChange records a change made through the HTTP API. The value is ignored for deletions.
+func auditChange(r *http.Request, op, key, value string) {
+	audit(newAuditRecord("http", r.RemoteAddr, identity(r), op, key, value))
+}
+
+func newAuditRecord(protocol, remote, identity, op, key, value string) auditRecord {
+	rec := auditRecord{Remote: remote, Identity: identity, Protocol: protocol, Op: op, Key: key}
+	if op != "delete" {
+		rec.ValueSHA256 = valueHash(value)
+	}
+	return rec
+}
+
+// audit appends the record to the audit log if it is enabled.
+func audit(rec auditRecord) {
+	if mutationLog == nil {
+		return
+	}
+	rec.Time = time.Now().UTC()
+	if err := mutationLog.record(rec); err != nil {
+		log.Printf("Failed to write the audit log: %s (record: %+v)", err, rec)
+	}
+}
+
+// handleAudit answers GET /admin/audit?from=&to=&key=&prefix=&limit= with the matching records, oldest first.
+// from and to are RFC 3339 times; from is inclusive, to is not.
+func handleAudit(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(rw, http.MethodGet)
+		return
+	}
+	if !authorizeAdmin(rw, r) {
+		return
+	}
+	if mutationLog == nil {
+		writeErrorStatus(rw, http.StatusNotFound, "no_audit_log", "The audit log is disabled, see -audit-log")
+		return
+	}
+	query := r.URL.Query()
+	filter := auditFilter{key: query.Get("key"), prefix: query.Get("prefix")}
+	for name, t := range map[string]*time.Time{"from": &filter.from, "to": &filter.to} {
+		if v := query.Get(name); v != "" {
+			var err error
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				writeErrorStatus(rw, http.StatusUnprocessableEntity, "invalid_value", name+" has to be an RFC 3339 time")
+				return
+			}
+		}
+	}
+	limit := defaultListLimit
+	if query.Has("limit") {
+		n, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || n < 1 || n > maxListLimit {
+			writeErrorStatus(rw, http.StatusUnprocessableEntity, "invalid_value", fmt.Sprintf("limit has to be between 1 and %d", maxListLimit))
+			return
+		}
+		limit = n
+	}
+	records, err := mutationLog.query(filter, limit)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	rw.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(rw).Encode(struct {
+		Records []auditRecord `json:"records"`
+	}{records})
+}
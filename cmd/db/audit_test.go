@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+func TestAuditLog(t *testing.T) {
+	newDb, err := datastore.NewDb("db", datastore.WithFS(datastore.NewMemFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newDb.Close()
+	db = newDb
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	// Small enough to rotate after every record
+	if mutationLog, err = openAuditLog(path, 100); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		mutationLog.Close()
+		mutationLog = nil
+	}()
+
+	start := time.Now()
+	for _, r := range []*http.Request{
+		httptest.NewRequest("PUT", "/db/a/1", strings.NewReader(`{"value":"one"}`)),
+		httptest.NewRequest("PUT", "/db/b/1", strings.NewReader(`{"type":"int64","value":1}`)),
+		// Failed changes aren't recorded
+		httptest.NewRequest("DELETE", "/db/missing", nil),
+		httptest.NewRequest("DELETE", "/db/a/1", nil),
+	} {
+		handleDb(httptest.NewRecorder(), r)
+	}
+	if files, err := mutationLog.rotated(); err != nil || len(files) != 2 {
+		t.Errorf("Expected 2 rotated files, got %v: %v", files, err)
+	}
+
+	query := func(query string) []auditRecord {
+		rw := httptest.NewRecorder()
+		handleAudit(rw, httptest.NewRequest("GET", "/admin/audit?"+query, nil))
+		if rw.Code != http.StatusOK {
+			t.Fatalf("Unexpected status %d: %s", rw.Code, rw.Body)
+		}
+		var data struct{ Records []auditRecord }
+		if err := json.Unmarshal(rw.Body.Bytes(), &data); err != nil {
+			t.Fatal(err)
+		}
+		return data.Records
+	}
+	records := query("")
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 records, got %+v", records)
+	}
+	first := records[0]
+	if first.Op != "put" || first.Key != "a/1" || first.Identity != "anonymous" || first.Protocol != "http" ||
+		first.ValueSHA256 != valueHash("one") || first.Remote == "" {
+		t.Errorf("Unexpected record %+v", first)
+	}
+	if records[2].Op != "delete" || records[2].ValueSHA256 != "" {
+		t.Errorf("Unexpected record of a deletion %+v", records[2])
+	}
+
+	if records := query("key=a/1"); len(records) != 2 {
+		t.Errorf("Expected 2 records of a/1, got %+v", records)
+	}
+	if records := query("prefix=b/&limit=1"); len(records) != 1 || records[0].Key != "b/1" {
+		t.Errorf("Expected the record of b/1, got %+v", records)
+	}
+	to := start.Add(-time.Second).Format(time.RFC3339)
+	if records := query("to=" + to); len(records) != 0 {
+		t.Errorf("Expected no records before %s, got %+v", to, records)
+	}
+	if records := query("from=" + start.Add(-time.Second).Format(time.RFC3339)); len(records) != 3 {
+		t.Errorf("Expected all records, got %+v", records)
+	}
+
+	// A rotated file removed by hand doesn't make the next rotation overwrite the newest one
+	if err := os.Remove(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	handleDb(httptest.NewRecorder(), httptest.NewRequest("PUT", "/db/c/1", strings.NewReader(`{"value":"three"}`)))
+	if files, err := mutationLog.rotated(); err != nil || !reflect.DeepEqual(files, []string{path + ".2", path + ".3"}) {
+		t.Errorf("Unexpected rotated files %v: %v", files, err)
+	}
+	if records := query(""); len(records) != 3 || records[2].Key != "c/1" {
+		t.Errorf("Expected the records of the files left, got %+v", records)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// With -auth-file every request has to carry a bearer token listed in the file:
+//
+//	tokens:
+//	  - name: server
+//	    token: 8f1c...
+//	    read: [""]
+//	    write: [team, cache/]
+//	  - name: ops
+//	    token: 05e2...
+//	    admin: true
+//
+// A token can read the keys starting with one of its read prefixes and write the ones starting
+// with one of its write prefixes, the empty prefix matching every key. Writing doesn't allow reading.
+// Without the file the service is open to everyone, as before.
+
+type permission string
+
+const (
+	permRead  permission = "read"
+	permWrite permission = "write"
+)
+
+type token struct {
+	Name  string   `yaml:"name"`
+	Token string   `yaml:"token"`
+	Read  []string `yaml:"read"`
+	Write []string `yaml:"write"`
+	// Allows the endpoints under /admin/
+	Admin bool `yaml:"admin"`
+}
+
+// allows tells whether the token has the permission for the key.
+// For a prefix of keys, it tells whether the token has it for all keys with the prefix.
+func (t *token) allows(perm permission, key string) bool {
+	prefixes := t.Read
+	if perm == permWrite {
+		prefixes = t.Write
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// The tokens of -auth-file, nil if authentication is disabled
+var tokens []*token
+
+// Denied requests are logged to stderr, apart from the changes recorded by -audit-log
+var denialLog = log.New(os.Stderr, "auth: ", log.LstdFlags)
+
+// readTokens reads the tokens from a YAML file.
+func readTokens(path string) ([]*token, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Tokens []*token `yaml:"tokens"`
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("can't read %s: %w", path, err)
+	}
+	names := make(map[string]bool)
+	for i, t := range file.Tokens {
+		if t.Name == "" || t.Token == "" {
+			return nil, fmt.Errorf("%s: token %d needs a name and a token", path, i)
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("%s: token name %q is used twice", path, t.Name)
+		}
+		names[t.Name] = true
+	}
+	if len(file.Tokens) == 0 {
+		return nil, fmt.Errorf("%s has no tokens", path)
+	}
+	return file.Tokens, nil
+}
+
+// findToken returns the token with the secret. All tokens are compared in constant time,
+// so the time taken doesn't tell how much of a secret is guessed.
+func findToken(secret string) *token {
+	var found *token
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(secret)) == 1 {
+			found = t
+		}
+	}
+	return found
+}
+
+type tokenKey struct{}
+
+var (
+	errUnauthorized = errors.New("a valid bearer token is required")
+	errForbidden    = errors.New("access denied")
+)
+
+// authenticate makes the requests to h carry a known bearer token when authentication is enabled.
+func authenticate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if tokens == nil {
+			h.ServeHTTP(rw, r)
+			return
+		}
+		secret, ok := strings.CutPrefix(r.Header.Get("authorization"), "Bearer ")
+		t := findToken(strings.TrimSpace(secret))
+		if !ok || t == nil {
+			denialLog.Printf("Denied %s %s from %s: no valid token", r.Method, r.URL.Path, r.RemoteAddr)
+			rw.Header().Set("www-authenticate", `Bearer realm="db"`)
+			writeErrorStatus(rw, http.StatusUnauthorized, "unauthorized", errUnauthorized.Error())
+			return
+		}
+		h.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), tokenKey{}, t)))
+	})
+}
+
+// authorize tells whether the token of the request has the permission for the key, or all keys
+// with the prefix. Otherwise it answers with 403 and records the denial in the audit log.
+func authorize(rw http.ResponseWriter, r *http.Request, perm permission, key string) bool {
+	if err := checkPermission(r, perm, key); err != nil {
+		writeError(rw, err)
+		return false
+	}
+	return true
+}
+
+// checkPermission is authorize which returns an error matching errForbidden instead of answering.
+func checkPermission(r *http.Request, perm permission, key string) error {
+	if allowed(r, perm, key) {
+		return nil
+	}
+	denialLog.Printf("Denied %s %s from %s: token %s can't %s %q", r.Method, r.URL.Path, r.RemoteAddr, identity(r), perm, key)
+	return fmt.Errorf("%w: the token can't %s %q", errForbidden, perm, key)
+}
+
+// authorizeAdmin tells whether the token of the request is an admin one, like authorize.
+func authorizeAdmin(rw http.ResponseWriter, r *http.Request) bool {
+	if tokens == nil {
+		return true
+	}
+	if t, ok := r.Context().Value(tokenKey{}).(*token); ok && t.Admin {
+		return true
+	}
+	denialLog.Printf("Denied %s %s from %s: token %s isn't an admin one", r.Method, r.URL.Path, r.RemoteAddr, identity(r))
+	writeError(rw, fmt.Errorf("%w: the token isn't an admin one", errForbidden))
+	return false
+}
+
+// allowed is authorize without the response, for filtering keys.
+func allowed(r *http.Request, perm permission, key string) bool {
+	if tokens == nil {
+		return true
+	}
+	t, _ := r.Context().Value(tokenKey{}).(*token)
+	return t != nil && t.allows(perm, key)
+}
+
+// identity returns the name of the token of the request, or "anonymous" without one.
+func identity(r *http.Request) string {
+	if t, ok := r.Context().Value(tokenKey{}).(*token); ok {
+		return t.Name
+	}
+	return "anonymous"
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+func TestAuth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.yaml")
+	file := `
+tokens:
+  - name: server
+    token: server-secret
+    read: [team, cache/]
+    write: [cache/]
+  - name: admin
+    token: admin-secret
+    read: [""]
+    write: [""]
+    admin: true
+`
+	if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if tokens, err = readTokens(path); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { tokens = nil }()
+	denialLog.SetOutput(io.Discard)
+
+	newDb, err := datastore.NewDb("db", datastore.WithFS(datastore.NewMemFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newDb.Close()
+	db = newDb
+	if err := db.Put("team", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	h := http.NewServeMux()
+	h.HandleFunc("/db/", handleDb)
+	h.HandleFunc("/db/_batch", handleBatch)
+	h.HandleFunc("/admin/audit", handleAudit)
+	server := authenticate(h)
+	for _, c := range []struct {
+		name, method, target, token, body string
+		status                            int
+	}{
+		{"no token", "GET", "/db/team", "", "", http.StatusUnauthorized},
+		{"unknown token", "GET", "/db/team", "secret", "", http.StatusUnauthorized},
+		{"read", "GET", "/db/team", "server-secret", "", http.StatusOK},
+		{"read without permission", "GET", "/db/user/1", "server-secret", "", http.StatusForbidden},
+		{"write without permission", "PUT", "/db/team", "server-secret", `{"value":"v"}`, http.StatusForbidden},
+		{"write", "PUT", "/db/cache/1", "server-secret", `{"value":"v"}`, http.StatusNoContent},
+		{"list a readable prefix", "GET", "/db/?prefix=cache/", "server-secret", "", http.StatusOK},
+		{"list everything", "GET", "/db/", "server-secret", "", http.StatusForbidden},
+		// The prefix of a listing doesn't stand for the empty key of a write
+		{"write the empty key", "PUT", "/db/?prefix=cache/", "server-secret", `{"value":"v"}`, http.StatusUnprocessableEntity},
+		{"post to the empty key", "POST", "/db/?prefix=cache/", "server-secret", `{"value":"v"}`, http.StatusUnprocessableEntity},
+		{"delete the empty key", "DELETE", "/db/?prefix=cache/", "server-secret", "", http.StatusUnprocessableEntity},
+		{"write the empty key as an admin", "PUT", "/db/", "admin-secret", `{"value":"v"}`, http.StatusUnprocessableEntity},
+		{"batch", "POST", "/db/_batch", "server-secret", `[{"op":"delete","key":"cache/1"},{"op":"delete","key":"team"}]`, http.StatusForbidden},
+		{"admin", "DELETE", "/db/team", "admin-secret", "", http.StatusNoContent},
+		{"audit log", "GET", "/admin/audit", "server-secret", "", http.StatusForbidden},
+		// Allowed, but the audit log is disabled
+		{"audit log of an admin", "GET", "/admin/audit", "admin-secret", "", http.StatusNotFound},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest(c.method, c.target, strings.NewReader(c.body))
+			if c.token != "" {
+				r.Header.Set("authorization", "Bearer "+c.token)
+			}
+			rw := httptest.NewRecorder()
+			server.ServeHTTP(rw, r)
+			if rw.Code != c.status {
+				t.Errorf("Expected status %d, got %d: %s", c.status, rw.Code, rw.Body)
+			}
+		})
+	}
+	// The denied batch isn't applied
+	if _, err := db.Get("cache/1"); err != nil {
+		t.Errorf("Expected cache/1 to stay: %v", err)
+	}
+
+	t.Run("RESP", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		go handleRESPConn(server)
+
+		requests := "GET cache/1\r\n" +
+			"AUTH wrong\r\n" +
+			"AUTH admin server-secret\r\n" +
+			"AUTH server server-secret\r\n" +
+			"GET cache/1\r\n" +
+			"SET team other\r\n" +
+			"DEL cache/1 user/1\r\n" +
+			"SCAN 0\r\n"
+		expected := "-NOAUTH Authentication required.\r\n" +
+			"-WRONGPASS invalid username-password pair or user is disabled.\r\n" +
+			"-WRONGPASS invalid username-password pair or user is disabled.\r\n" +
+			"+OK\r\n" +
+			"$1\r\nv\r\n" +
+			"-NOPERM this token can't write \"team\"\r\n" +
+			"-NOPERM this token can't write \"user/1\"\r\n" +
+			"*2\r\n$1\r\n0\r\n*1\r\n$7\r\ncache/1\r\n"
+		go func() {
+			io.WriteString(client, requests)
+		}()
+		reply := make([]byte, len(expected))
+		if _, err := io.ReadFull(bufio.NewReader(client), reply); err != nil {
+			t.Fatal(err)
+		}
+		if string(reply) != expected {
+			t.Errorf("Unexpected replies:\n%s\nexpected:\n%s", reply, expected)
+		}
+	})
+}
+
+func TestReadTokens(t *testing.T) {
+	dir := t.TempDir()
+	for name, file := range map[string]string{
+		"no tokens":    "tokens: []\n",
+		"no secret":    "tokens:\n  - name: a\n",
+		"same names":   "tokens:\n  - {name: a, token: x}\n  - {name: a, token: y}\n",
+		"unknown keys": "tokens:\n  - {name: a, token: x, expires: 2030-01-01}\n",
+	} {
+		path := filepath.Join(dir, "tokens.yaml")
+		if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readTokens(path); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+// The largest number of operations in a batch and of keys in a multi-get
+const maxBatchSize = 1000
+
+// batchOp is an operation of POST /db/_batch.
+type batchOp struct {
+	// "put" or "delete"
+	Op    string          `json:"op"`
+	Key   string          `json:"key"`
+	Type  string          `json:"type,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+type batchResult struct {
+	Key    string    `json:"key"`
+	Status int       `json:"status"`
+	Error  *apiError `json:"error,omitempty"`
+}
+
+// handleBatch applies a JSON array of operations in their order.
+// The whole batch is validated and authorized before any operation is applied, but it is not atomic:
+// each operation succeeds or fails on its own, and the response has a result for every one of them.
+func handleBatch(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(rw, http.MethodPost)
+		return
+	}
+	var ops []batchOp
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		writeErrorStatus(rw, http.StatusBadRequest, "bad_request", "Malformed JSON body: "+err.Error())
+		return
+	}
+	if len(ops) > maxBatchSize {
+		writeErrorStatus(rw, http.StatusRequestEntityTooLarge, "batch_too_large",
+			fmt.Sprintf("A batch can have up to %d operations", maxBatchSize))
+		return
+	}
+	values := make([]string, len(ops))
+	for i, op := range ops {
+		var err error
+		values[i], err = op.validate()
+		if err == nil && !authorize(rw, r, permWrite, op.Key) {
+			return
+		}
+		if err != nil {
+			status, code := errorStatus(err)
+			writeErrorStatus(rw, status, code, fmt.Sprintf("Operation %d: %s", i, err))
+			return
+		}
+	}
+
+	results := make([]batchResult, len(ops))
+	for i, op := range ops {
+		var err error
+		if op.Op == "delete" {
+			err = db.DeleteContext(r.Context(), op.Key)
+		} else {
+			_, err = typeToPutter(op.Type)(r.Context(), op.Key, values[i], datastore.Condition{})
+		}
+		results[i] = batchResult{Key: op.Key, Status: http.StatusNoContent}
+		if err != nil {
+			status, code := errorStatus(err)
+			results[i].Status, results[i].Error = status, &apiError{code, err.Error()}
+		} else {
+			auditChange(r, op.Op, op.Key, values[i])
+		}
+	}
+	rw.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(rw).Encode(struct {
+		Results []batchResult `json:"results"`
+	}{results})
+}
+
+// validate checks the operation and returns the text of the value to put.
+func (op batchOp) validate() (string, error) {
+	if op.Key == "" {
+		return "", fmt.Errorf("%w: key is missing", errMissingValue)
+	}
+	switch op.Op {
+	case "delete":
+		return "", nil
+	case "put":
+		if typeToPutter(op.Type) == nil {
+			return "", errUnknownType
+		}
+		value, err := jsonValueText(op.Type, op.Value)
+		if err == nil && op.Type == "int64" {
+			if _, perr := strconv.ParseInt(value, 10, 64); perr != nil {
+				err = errConvertType
+			}
+		}
+		if err == nil && value == "" && op.Type != "int64" {
+			err = errEmptyValue
+		}
+		return value, err
+	}
+	return "", fmt.Errorf("%w: unknown operation %q", errInvalidOp, op.Op)
+}
+
+// mgetEntry is a value of GET /db/_mget and of key listings. int64 values are JSON numbers, like in GET /db/{key}.
+type mgetEntry struct {
+	Key   string      `json:"key"`
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+func newMgetEntry(key, vType, value string) mgetEntry {
+	if vType == "int64" {
+		return mgetEntry{key, vType, json.Number(value)}
+	}
+	return mgetEntry{key, vType, value}
+}
+
+// handleMget returns the values of the keys given with repeated key parameters.
+// Missing keys are listed separately rather than failing the request.
+func handleMget(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(rw, http.MethodGet)
+		return
+	}
+	keys := r.URL.Query()["key"]
+	if len(keys) > maxBatchSize {
+		writeErrorStatus(rw, http.StatusRequestEntityTooLarge, "batch_too_large",
+			fmt.Sprintf("Up to %d keys can be requested at once", maxBatchSize))
+		return
+	}
+	data := struct {
+		Entries []mgetEntry `json:"entries"`
+		Missing []string    `json:"missing"`
+	}{make([]mgetEntry, 0, len(keys)), make([]string, 0)}
+	for _, key := range keys {
+		if !authorize(rw, r, permRead, key) {
+			return
+		}
+	}
+	for _, key := range keys {
+		value, vType, err := db.LookupContext(r.Context(), key)
+		if errors.Is(err, datastore.ErrNotFound) {
+			data.Missing = append(data.Missing, key)
+			continue
+		}
+		if err != nil {
+			writeError(rw, err)
+			return
+		}
+		data.Entries = append(data.Entries, newMgetEntry(key, vType, value))
+	}
+	rw.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(rw).Encode(data)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+func TestBatch(t *testing.T) {
+	newDb, err := datastore.NewDb("db", datastore.WithFS(datastore.NewMemFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newDb.Close()
+	db = newDb
+	if err := db.Put("old", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	batch := func(body string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		handleBatch(rw, httptest.NewRequest("POST", "/db/_batch", strings.NewReader(body)))
+		return rw
+	}
+
+	rw := batch(`[
+		{"op": "put", "key": "a", "value": "1"},
+		{"op": "put", "key": "n", "type": "int64", "value": 42},
+		{"op": "delete", "key": "old"},
+		{"op": "delete", "key": "missing"}
+	]`)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", rw.Code, rw.Body)
+	}
+	var data struct {
+		Results []batchResult
+	}
+	if err := json.Unmarshal(rw.Body.Bytes(), &data); err != nil {
+		t.Fatal(err)
+	}
+	var statuses []int
+	for _, result := range data.Results {
+		statuses = append(statuses, result.Status)
+	}
+	if expected := []int{204, 204, 204, 404}; !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("Expected statuses %v, got %v", expected, statuses)
+	}
+
+	// An invalid operation rejects the whole batch
+	rw = batch(`[{"op": "put", "key": "b", "value": "1"}, {"op": "put", "key": "c", "type": "int64", "value": "x"}]`)
+	if rw.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422, got %d: %s", rw.Code, rw.Body)
+	}
+	if exists, _ := db.Exists("b"); exists {
+		t.Error("Operations of a rejected batch were applied")
+	}
+	if rw = batch(`[{"op": "merge", "key": "b"}]`); rw.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for an unknown operation, got %d", rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	handleMget(rw, httptest.NewRequest("GET", "/db/_mget?key=a&key=old&key=n", nil))
+	expected := `{"entries":[{"key":"a","type":"string","value":"1"},{"key":"n","type":"int64","value":42}],"missing":["old"]}`
+	if strings.TrimSpace(rw.Body.String()) != expected {
+		t.Errorf("Unexpected response %s", rw.Body)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+// GET /db/_export and POST /db/_import move data between databases as newline-delimited JSON
+// (https://github.com/ndjson/ndjson-spec): one {"key", "type", "value"} record per line,
+// with int64 values as JSON numbers, like the entries of GET /db/_mget.
+// An import named with ?id= reports its progress to GET /db/_import?id= of the same client
+// while it runs, as the response of the import itself comes only once the body is read.
+
+const ndjsonContentType = "application/x-ndjson"
+
+// Records between extensions of the deadlines of the connection, which are too short
+// for a transfer of the whole database, and between the import lines of the server log
+const bulkChunk = 1000
+
+// The time to transfer a chunk of records
+const bulkChunkTimeout = 10 * time.Second
+
+// The time the progress of a named import is kept after it finishes
+const importProgressTTL = 10 * time.Minute
+
+var errImportRunning = errors.New("An import with this id is running")
+
+// handleExport streams the values of the keys starting with ?prefix= as they were when the export started.
+func handleExport(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(rw, http.MethodGet)
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	if !authorize(rw, r, permRead, prefix) {
+		return
+	}
+	snapshot, err := db.Snapshot(prefix)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	defer snapshot.Close()
+
+	rc := http.NewResponseController(rw)
+	rw.Header().Set("content-type", ndjsonContentType)
+	w := bufio.NewWriter(rw)
+	enc := json.NewEncoder(w)
+	n := 0
+	err = snapshot.ForEach(func(key, vType, value string) error {
+		if isMemcachedMeta(key) {
+			return nil
+		}
+		if n%bulkChunk == 0 {
+			_ = rc.SetWriteDeadline(time.Now().Add(bulkChunkTimeout))
+		}
+		n++
+		if err := r.Context().Err(); err != nil {
+			return err
+		}
+		return enc.Encode(newMgetEntry(key, vType, value))
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		// The status is sent already, the client sees a truncated body
+		log.Printf("Export of %q failed after %d records: %s", prefix, n, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// importResult is the response of POST /db/_import. A failed import stops at the first bad record,
+// all records before it are imported.
+type importResult struct {
+	Imported int `json:"imported"`
+	// The number of the bad record, counted from 1
+	Record int       `json:"record,omitempty"`
+	Error  *apiError `json:"error,omitempty"`
+	// Set in the progress of an import which hasn't finished yet
+	Running bool `json:"running,omitempty"`
+}
+
+// importProgress is the progress of an import named with ?id=.
+type importProgress struct {
+	id string
+	// Only the client which started the import can see its progress
+	identity string
+	result   importResult
+}
+
+var (
+	importsMu sync.Mutex
+	imports   = make(map[string]*importProgress)
+)
+
+// startImport registers the progress of the import, if it is named. It returns nil otherwise.
+func startImport(r *http.Request) (*importProgress, error) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		return nil, nil
+	}
+	importsMu.Lock()
+	defer importsMu.Unlock()
+	if p, ok := imports[id]; ok && p.result.Running {
+		return nil, fmt.Errorf("%w: %s", errImportRunning, id)
+	}
+	p := &importProgress{id: id, identity: identity(r), result: importResult{Running: true}}
+	imports[id] = p
+	return p, nil
+}
+
+func (p *importProgress) update(result importResult) {
+	if p == nil {
+		return
+	}
+	importsMu.Lock()
+	defer importsMu.Unlock()
+	p.result = result
+	p.result.Running = true
+}
+
+// finish records the final result of the import, which is kept for importProgressTTL.
+func (p *importProgress) finish(result importResult) {
+	if p == nil {
+		return
+	}
+	importsMu.Lock()
+	defer importsMu.Unlock()
+	p.result = result
+	time.AfterFunc(importProgressTTL, func() {
+		importsMu.Lock()
+		defer importsMu.Unlock()
+		if imports[p.id] == p {
+			delete(imports, p.id)
+		}
+	})
+}
+
+// handleImportProgress answers with the result of the import so far.
+func handleImportProgress(rw http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeError(rw, fmt.Errorf("%w: id of the import", errMissingValue))
+		return
+	}
+	importsMu.Lock()
+	p, ok := imports[id]
+	var result importResult
+	if ok {
+		result = p.result
+	}
+	importsMu.Unlock()
+	if !ok || p.identity != identity(r) {
+		writeError(rw, fmt.Errorf("import %s: %w", id, datastore.ErrNotFound))
+		return
+	}
+	rw.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(rw).Encode(result)
+}
+
+// handleImport puts the records of the NDJSON body in their order.
+func handleImport(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		handleImportProgress(rw, r)
+		return
+	case http.MethodPost:
+	default:
+		writeMethodNotAllowed(rw, http.MethodGet, http.MethodPost)
+		return
+	}
+	progress, err := startImport(r)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	var result importResult
+	defer func() {
+		progress.finish(result)
+	}()
+	rc := http.NewResponseController(rw)
+	dec := json.NewDecoder(r.Body)
+	start := time.Now()
+	for {
+		if result.Imported%bulkChunk == 0 {
+			// The write deadline counts from the start of the request too, it has to last until the response
+			deadline := time.Now().Add(bulkChunkTimeout)
+			_ = rc.SetReadDeadline(deadline)
+			_ = rc.SetWriteDeadline(deadline)
+			if result.Imported > 0 {
+				log.Printf("Import: %d records in %s", result.Imported, time.Since(start).Round(time.Millisecond))
+			}
+		}
+		var op batchOp
+		err := dec.Decode(&op)
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = importRecord(r, op)
+		}
+		if err != nil {
+			var syntaxErr *json.SyntaxError
+			if errors.As(err, &syntaxErr) || errors.As(err, new(*json.UnmarshalTypeError)) {
+				err = fmt.Errorf("%w: malformed record: %s", errInvalidOp, err)
+			}
+			status, code := errorStatus(err)
+			result.Record, result.Error = result.Imported+1, &apiError{code, err.Error()}
+			log.Printf("Import failed at record %d: %s", result.Record, err)
+			rw.Header().Set("content-type", "application/json")
+			rw.WriteHeader(status)
+			_ = json.NewEncoder(rw).Encode(result)
+			return
+		}
+		result.Imported++
+		progress.update(result)
+	}
+	log.Printf("Import: %d records in %s, done", result.Imported, time.Since(start).Round(time.Millisecond))
+	rw.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(rw).Encode(result)
+}
+
+func importRecord(r *http.Request, op batchOp) error {
+	op.Op = "put"
+	value, err := op.validate()
+	if err != nil {
+		return err
+	}
+	if err := checkPermission(r, permWrite, op.Key); err != nil {
+		return err
+	}
+	if _, err = typeToPutter(op.Type)(r.Context(), op.Key, value, datastore.Condition{}); err != nil {
+		return err
+	}
+	auditChange(r, "put", op.Key, value)
+	return nil
+}
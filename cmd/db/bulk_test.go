@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+func TestImportExport(t *testing.T) {
+	newDb, err := datastore.NewDb("db", datastore.WithFS(datastore.NewMemFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newDb.Close()
+	db = newDb
+
+	records := `{"key":"a/1","type":"string","value":"one"}
+{"key":"a/2","type":"int64","value":2}
+{"key":"b/1","value":"default type"}
+`
+	rw := httptest.NewRecorder()
+	handleImport(rw, httptest.NewRequest("POST", "/db/_import", strings.NewReader(records)))
+	if rw.Code != http.StatusOK || strings.TrimSpace(rw.Body.String()) != `{"imported":3}` {
+		t.Fatalf("Unexpected response %d: %s", rw.Code, rw.Body)
+	}
+	if n, err := db.GetInt64("a/2"); err != nil || n != 2 {
+		t.Errorf("Bad imported value %d: %v", n, err)
+	}
+
+	rw = httptest.NewRecorder()
+	handleExport(rw, httptest.NewRequest("GET", "/db/_export?prefix=a/", nil))
+	expected := `{"key":"a/1","type":"string","value":"one"}
+{"key":"a/2","type":"int64","value":2}
+`
+	if rw.Code != http.StatusOK || rw.Body.String() != expected || rw.Header().Get("content-type") != ndjsonContentType {
+		t.Errorf("Unexpected export %d:\n%s", rw.Code, rw.Body)
+	}
+
+	for name, c := range map[string]struct {
+		records string
+		status  int
+		code    string
+	}{
+		"bad type":   {`{"key":"c/1","value":"x"}` + "\n" + `{"key":"c/2","type":"float","value":1}`, http.StatusUnprocessableEntity, "invalid_value"},
+		"bad json":   {`{"key":"c/1","value":"x"}` + "\n" + `{"key" "c/2"}`, http.StatusUnprocessableEntity, "invalid_value"},
+		"wrong type": {`{"key":"c/1","value":"x"}` + "\n" + `{"key":"c/2","type":"int64","value":"x"}`, http.StatusUnprocessableEntity, "invalid_value"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			handleImport(rw, httptest.NewRequest("POST", "/db/_import", strings.NewReader(c.records)))
+			var result importResult
+			if err := json.Unmarshal(rw.Body.Bytes(), &result); err != nil {
+				t.Fatal(err)
+			}
+			if rw.Code != c.status || result.Imported != 1 || result.Record != 2 || result.Error == nil || result.Error.Code != c.code {
+				t.Errorf("Unexpected response %d: %s", rw.Code, rw.Body)
+			}
+		})
+	}
+}
+
+func TestImportOutlastsTimeouts(t *testing.T) {
+	newDb, err := datastore.NewDb("db", datastore.WithFS(datastore.NewMemFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newDb.Close()
+	db = newDb
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(handleImport))
+	server.Config.ReadTimeout = 100 * time.Millisecond
+	server.Config.WriteTimeout = 100 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	// The body takes longer than both timeouts
+	body, w := io.Pipe()
+	go func() {
+		io.WriteString(w, `{"key":"a","value":"1"}`+"\n")
+		time.Sleep(300 * time.Millisecond)
+		io.WriteString(w, `{"key":"b","value":"2"}`+"\n")
+		w.Close()
+	}()
+	resp, err := http.Post(server.URL, ndjsonContentType, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK || strings.TrimSpace(string(data)) != `{"imported":2}` {
+		t.Errorf("Unexpected response %d: %s (%v)", resp.StatusCode, data, err)
+	}
+}
+
+func TestImportProgress(t *testing.T) {
+	newDb, err := datastore.NewDb("db", datastore.WithFS(datastore.NewMemFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newDb.Close()
+	db = newDb
+
+	server := httptest.NewServer(http.HandlerFunc(handleImport))
+	defer server.Close()
+	progress := func(id string) (int, string) {
+		resp, err := http.Get(server.URL + "?id=" + id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, strings.TrimSpace(string(data))
+	}
+
+	body, w := io.Pipe()
+	done := make(chan string)
+	go func() {
+		resp, err := http.Post(server.URL+"?id=job", ndjsonContentType, body)
+		if err != nil {
+			done <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		done <- strings.TrimSpace(string(data))
+	}()
+	io.WriteString(w, `{"key":"a","value":"1"}`+"\n")
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		status, p := progress("job")
+		if status == http.StatusOK && p == `{"imported":1,"running":true}` {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Unexpected progress %d: %s", status, p)
+		}
+	}
+	resp, err := http.Post(server.URL+"?id=job", ndjsonContentType, strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected a conflict with the running import, got %d", resp.StatusCode)
+	}
+
+	io.WriteString(w, `{"key":"b","value":"2"}`+"\n")
+	w.Close()
+	if result := <-done; result != `{"imported":2}` {
+		t.Errorf("Unexpected result %s", result)
+	}
+	if status, p := progress("job"); status != http.StatusOK || p != `{"imported":2}` {
+		t.Errorf("Unexpected progress of the finished import %d: %s", status, p)
+	}
+	if status, _ := progress("other"); status != http.StatusNotFound {
+		t.Errorf("Expected an unknown import not to be found, got %d", status)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+	"gopkg.in/yaml.v3"
+)
+
+// config holds the settings of the db service. They come from flags and an optional YAML file
+// given with -config, whose keys are the names of the flags. Flags given explicitly override the file.
+type config struct {
+	Dir      string `yaml:"dir" json:"dir"`
+	Port     int    `yaml:"port" json:"port"`
+	Addr     string `yaml:"addr" json:"addr"`
+	TLSCert  string `yaml:"tls-cert" json:"tls-cert"`
+	TLSKey   string `yaml:"tls-key" json:"tls-key"`
+	RESPPort int    `yaml:"resp-port" json:"resp-port"`
+	AuthFile string `yaml:"auth-file" json:"auth-file"`
+
+	AuditLog     string `yaml:"audit-log" json:"audit-log"`
+	AuditLogSize int64  `yaml:"audit-log-size" json:"audit-log-size"`
+
+	MemcachedPort int   `yaml:"memcached-port" json:"memcached-port"`
+	SegmentSize   int64 `yaml:"segment-size" json:"segment-size"`
+	// "none", "always" or an interval, such as "1s"
+	Sync           string   `yaml:"sync" json:"sync"`
+	MergeThreshold int      `yaml:"merge-threshold" json:"merge-threshold"`
+	MaxVersions    int      `yaml:"max-versions" json:"max-versions"`
+	Retention      duration `yaml:"retention" json:"retention"`
+	MaxKeySize     int64    `yaml:"max-key-size" json:"max-key-size"`
+	MaxValueSize   int64    `yaml:"max-value-size" json:"max-value-size"`
+	MaxDiskSize    int64    `yaml:"max-disk-size" json:"max-disk-size"`
+
+	OpTimeout duration   `yaml:"op-timeout" json:"op-timeout"`
+	SlowOp    duration   `yaml:"slow-op" json:"slow-op"`
+	Indexes   indexFlags `yaml:"index" json:"index"`
+}
+
+func defaultConfig() config {
+	return config{
+		Dir:            "./out",
+		Port:           8100,
+		SegmentSize:    datastore.DefaultSegmentSize,
+		Sync:           "none",
+		MergeThreshold: 2,
+		MaxVersions:    1,
+		AuditLogSize:   64 << 20,
+		MaxKeySize:     datastore.DefaultMaxKeySize,
+		MaxValueSize:   datastore.DefaultMaxValueSize,
+	}
+}
+
+func (c *config) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.Dir, "dir", c.Dir, "directory of the database")
+	fs.IntVar(&c.Port, "port", c.Port, "server port")
+	fs.StringVar(&c.Addr, "addr", c.Addr, "listen address of the HTTP server, such as 127.0.0.1:8100; overrides -port")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "certificate file to serve HTTPS with, together with -tls-key")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "private key file of the certificate")
+	fs.StringVar(&c.AuthFile, "auth-file", c.AuthFile, "YAML file with the bearer tokens of clients and their permissions, all clients are allowed everything without it")
+	fs.StringVar(&c.AuditLog, "audit-log", c.AuditLog, "file to record every change of the data in, with the identity of the client; disabled if empty")
+	fs.Int64Var(&c.AuditLogSize, "audit-log-size", c.AuditLogSize, "size in bytes after which the audit log is rotated")
+	fs.IntVar(&c.RESPPort, "resp-port", c.RESPPort, "port of the Redis protocol (RESP) listener, disabled if 0")
+	fs.IntVar(&c.MemcachedPort, "memcached-port", c.MemcachedPort, "port of the memcached text protocol listener, disabled if 0")
+	fs.Int64Var(&c.SegmentSize, "segment-size", c.SegmentSize, "size in bytes after which a new segment is started")
+	fs.StringVar(&c.Sync, "sync", c.Sync, "when writes are synced to disk: none (left to the OS), always, or an interval such as 1s")
+	fs.IntVar(&c.MergeThreshold, "merge-threshold", c.MergeThreshold, "number of inactive segments that triggers a merge (0 disables merges)")
+	fs.IntVar(&c.MaxVersions, "max-versions", c.MaxVersions, "number of versions of every key kept through merges")
+	fs.DurationVar((*time.Duration)(&c.Retention), "retention", time.Duration(c.Retention), "keep all versions younger than this through merges")
+	fs.Int64Var(&c.MaxKeySize, "max-key-size", c.MaxKeySize, "maximum key length in bytes")
+	fs.Int64Var(&c.MaxValueSize, "max-value-size", c.MaxValueSize, "maximum value size in bytes")
+	fs.Int64Var(&c.MaxDiskSize, "max-disk-size", c.MaxDiskSize, "maximum total size of segments in bytes (0 means no limit)")
+	fs.DurationVar((*time.Duration)(&c.OpTimeout), "op-timeout", time.Duration(c.OpTimeout), "abandon database operations taking longer than this")
+	fs.DurationVar((*time.Duration)(&c.SlowOp), "slow-op", time.Duration(c.SlowOp), "log database operations taking longer than this")
+	fs.Var(&c.Indexes, "index", "declare a secondary index over a JSON field as name:key-prefix:field.path (repeatable)")
+}
+
+// loadConfig parses the command line arguments and the configuration file they point to.
+func loadConfig(args []string) (config, error) {
+	c := defaultConfig()
+	fs := flag.NewFlagSet("db", flag.ContinueOnError)
+	path := fs.String("config", "", "YAML file with the settings, keyed by the names of the flags")
+	c.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+	if *path != "" {
+		fromFile, err := readConfigFile(*path)
+		if err != nil {
+			return c, err
+		}
+		set := make(map[string]bool)
+		fs.Visit(func(f *flag.Flag) {
+			set[f.Name] = true
+		})
+		cv, fv := reflect.ValueOf(&c).Elem(), reflect.ValueOf(fromFile)
+		for i := 0; i < cv.NumField(); i++ {
+			if name := cv.Type().Field(i).Tag.Get("yaml"); !set[name] {
+				cv.Field(i).Set(fv.Field(i))
+			}
+		}
+	}
+	return c, c.validate()
+}
+
+// readConfigFile reads the settings from a YAML file. Settings missing from it have their default values.
+func readConfigFile(path string) (config, error) {
+	c := defaultConfig()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&c); err != nil && err != io.EOF {
+		return c, fmt.Errorf("can't read %s: %w", path, err)
+	}
+	return c, nil
+}
+
+func (c config) validate() error {
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("tls-cert and tls-key have to be given together")
+	}
+	if c.AuthFile != "" && c.MemcachedPort > 0 {
+		return errors.New("memcached-port can't be used with auth-file, as the memcached text protocol has no authentication")
+	}
+	if c.AuditLogSize <= 0 {
+		return errors.New("audit-log-size has to be positive")
+	}
+	if c.MergeThreshold < 0 {
+		return errors.New("merge-threshold can't be negative")
+	}
+	_, err := c.dbOptions()
+	return err
+}
+
+// addr returns the listen address of the HTTP server.
+func (c config) addr() string {
+	if c.Addr != "" {
+		return c.Addr
+	}
+	return fmt.Sprintf(":%d", c.Port)
+}
+
+// dbOptions returns the options of the datastore.Db described by the configuration.
+func (c config) dbOptions() ([]datastore.Option, error) {
+	opts := []datastore.Option{
+		datastore.WithSegmentSize(c.SegmentSize),
+		datastore.WithMergeThreshold(c.MergeThreshold),
+		datastore.WithMaxVersions(c.MaxVersions),
+		datastore.WithRetention(time.Duration(c.Retention)),
+		datastore.WithMaxKeySize(c.MaxKeySize),
+		datastore.WithMaxValueSize(c.MaxValueSize),
+		datastore.WithMaxDiskSize(c.MaxDiskSize),
+	}
+	switch c.Sync {
+	case "", "none":
+	case "always":
+		opts = append(opts, datastore.WithSyncWrites())
+	default:
+		d, err := time.ParseDuration(c.Sync)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("sync has to be none, always or a positive interval, got %q", c.Sync)
+		}
+		opts = append(opts, datastore.WithSyncInterval(d))
+	}
+	return opts, nil
+}
+
+func (c config) String() string {
+	data, _ := json.Marshal(c)
+	return string(data)
+}
+
+// handleConfig shows the effective configuration.
+func handleConfig(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(rw, http.MethodGet)
+		return
+	}
+	rw.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(rw).Encode(cfg)
+}
+
+// duration is a time.Duration written as text, such as "1m30s", in the configuration file and endpoint.
+type duration time.Duration
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(strings.TrimSpace(string(text)))
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
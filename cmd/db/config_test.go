@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.yaml")
+	file := `
+dir: /data
+segment-size: 1000
+sync: 100ms
+slow-op: 2s
+index:
+  - name: email
+    prefix: user/
+    path: email
+`
+	if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := loadConfig([]string{"-config", path, "-segment-size", "2000", "-port", "9000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Dir != "/data" || c.Sync != "100ms" || time.Duration(c.SlowOp) != 2*time.Second {
+		t.Errorf("Settings are not read from the file: %s", c)
+	}
+	if c.SegmentSize != 2000 || c.Port != 9000 || c.addr() != ":9000" {
+		t.Errorf("Flags don't override the file: %s", c)
+	}
+	if c.MaxVersions != 1 || c.MaxValueSize != datastore.DefaultMaxValueSize {
+		t.Errorf("Settings missing from both don't have default values: %s", c)
+	}
+	if len(c.Indexes) != 1 || c.Indexes[0] != (datastore.Index{Name: "email", Prefix: "user/", Path: "email"}) {
+		t.Errorf("Unexpected indexes %v", c.Indexes)
+	}
+
+	for name, args := range map[string][]string{
+		"bad sync":       {"-sync", "sometimes"},
+		"cert only":      {"-tls-cert", "cert.pem"},
+		"missing file":   {"-config", filepath.Join(t.TempDir(), "missing.yaml")},
+		"unknown flag":   {"-segments", "10"},
+		"bad threshold":  {"-merge-threshold", "-1"},
+		"memcached auth": {"-auth-file", "tokens.yaml", "-memcached-port", "11211"},
+	} {
+		if _, err := loadConfig(args); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("segments: 10\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig([]string{"-config", path}); err == nil {
+		t.Error("Expected an error for an unknown setting in the file")
+	}
+}
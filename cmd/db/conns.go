@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// connGroup tracks the open connections of the RESP or memcached listener, so they can be
+// drained on shutdown before the database is closed.
+type connGroup struct {
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	draining bool
+	wg       sync.WaitGroup
+}
+
+// serve accepts connections until the listener is closed and runs handle for each of them.
+func (g *connGroup) serve(ln net.Listener, protocol string, handle func(conn net.Conn)) {
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to accept a %s connection: %s", protocol, err)
+			continue
+		}
+		g.add(conn)
+		go func() {
+			defer g.remove(conn)
+			handle(conn)
+		}()
+	}
+}
+
+func (g *connGroup) add(conn net.Conn) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.conns == nil {
+		g.conns = make(map[net.Conn]struct{})
+	}
+	g.conns[conn] = struct{}{}
+	g.wg.Add(1)
+	if g.draining {
+		conn.SetReadDeadline(time.Now())
+	}
+}
+
+func (g *connGroup) remove(conn net.Conn) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.conns, conn)
+	g.wg.Done()
+}
+
+// drain stops the connections from reading new commands and waits until the handlers
+// answer the commands already read and return. The connections still open when ctx
+// expires are closed.
+func (g *connGroup) drain(ctx context.Context) error {
+	g.mu.Lock()
+	g.draining = true
+	for conn := range g.conns {
+		// Unblocks the reads of idle connections, the replies can still be written
+		conn.SetReadDeadline(time.Now())
+	}
+	g.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		for conn := range g.conns {
+			conn.Close()
+		}
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+func TestConnGroupDrain(t *testing.T) {
+	newDb, err := datastore.NewDb("db", datastore.WithFS(datastore.NewMemFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newDb.Close()
+	db = newDb
+
+	started, release := make(chan struct{}), make(chan struct{})
+	// Answers a line after it is released, as a slow command would
+	slow := func(conn net.Conn) {
+		defer conn.Close()
+		if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+			return
+		}
+		close(started)
+		<-release
+		io.WriteString(conn, "done\r\n")
+	}
+	handlers := map[string]func(net.Conn){"idle": handleRESPConn, "slow": slow}
+	groups := make(map[string]*connGroup)
+	clients := make(map[string]net.Conn)
+	for name, handle := range handlers {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		groups[name] = new(connGroup)
+		go groups[name].serve(ln, name, handle)
+		if clients[name], err = net.Dial("tcp", ln.Addr().String()); err != nil {
+			t.Fatal(err)
+		}
+		defer clients[name].Close()
+	}
+
+	// An idle connection is closed without an error reply
+	r := bufio.NewReader(clients["idle"])
+	io.WriteString(clients["idle"], "PING\r\n")
+	if line, err := r.ReadString('\n'); line != "+PONG\r\n" {
+		t.Fatalf("Unexpected reply %q: %v", line, err)
+	}
+	if err := groups["idle"].drain(context.Background()); err != nil {
+		t.Errorf("Failed to drain the idle connection: %s", err)
+	}
+	if rest, err := io.ReadAll(r); err != nil || len(rest) != 0 {
+		t.Errorf("Unexpected data %q after the drain: %v", rest, err)
+	}
+
+	// A command being run is answered
+	io.WriteString(clients["slow"], "command\r\n")
+	<-started
+	drained := make(chan error)
+	go func() {
+		drained <- groups["slow"].drain(context.Background())
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	if err := <-drained; err != nil {
+		t.Errorf("Failed to drain the slow connection: %s", err)
+	}
+	if reply, err := io.ReadAll(clients["slow"]); err != nil || string(reply) != "done\r\n" {
+		t.Errorf("Unexpected reply %q: %v", reply, err)
+	}
+}
+
+func TestConnGroupDrainTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	g := new(connGroup)
+	g.add(server)
+	go func() {
+		defer g.remove(server)
+		// Blocked until the connection is closed, the read deadline doesn't affect writes
+		io.WriteString(server, "never read")
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := g.drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the drain to time out, got %v", err)
+	}
+	// The handler returns once its connection is closed
+	g.wg.Wait()
+}
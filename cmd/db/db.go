@@ -1,115 +1,414 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"log"
+	"net"
 	"net/http"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/roman-mazur/design-practice-2-template/datastore"
 	"github.com/roman-mazur/design-practice-2-template/httptools"
 	"github.com/roman-mazur/design-practice-2-template/signal"
 )
 
-var port = flag.Int("port", 8100, "server port")
+// The effective configuration
+var cfg = defaultConfig()
 var db *datastore.Db
 
 func main() {
-	flag.Parse()
+	c, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration: %s", err)
+	}
+	cfg = c
+	log.Printf("Configuration: %s", cfg)
+
+	opts, _ := cfg.dbOptions()
 	h := new(http.ServeMux)
-	newDb, err := datastore.NewDb("./out")
+	newDb, err := datastore.NewDb(cfg.Dir, append(opts, datastore.WithObserver(observeOp))...)
 	if err != nil {
 		panic(err)
 	}
 	db = newDb
+	if err := ensureIndexes(db, cfg.Indexes); err != nil {
+		panic(err)
+	}
 
 	h.HandleFunc("/db/", handleDb)
+	h.HandleFunc("/db/_find", handleFind)
+	h.HandleFunc("/db/_batch", handleBatch)
+	h.HandleFunc("/db/_mget", handleMget)
+	h.HandleFunc("/db/_import", handleImport)
+	h.HandleFunc("/db/_export", handleExport)
+	h.HandleFunc("/config", handleConfig)
+	h.HandleFunc("/metrics", handleMetrics)
+	h.HandleFunc("/stats", handleStats)
+	h.HandleFunc("/admin/audit", handleAudit)
+	if cfg.AuditLog != "" {
+		if mutationLog, err = openAuditLog(cfg.AuditLog, cfg.AuditLogSize); err != nil {
+			log.Fatalf("Failed to open the audit log: %s", err)
+		}
+	}
+	if cfg.AuthFile != "" {
+		if tokens, err = readTokens(cfg.AuthFile); err != nil {
+			log.Fatalf("Invalid tokens: %s", err)
+		}
+	}
+
+	if cfg.RESPPort > 0 {
+		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.RESPPort))
+		if err != nil {
+			panic(err)
+		}
+		conns := new(connGroup)
+		go conns.serve(ln, "RESP", handleRESPConn)
+		// In-flight commands are answered before the database is closed
+		signal.OnShutdown("RESP server", func(ctx context.Context) error {
+			if err := ln.Close(); err != nil {
+				return err
+			}
+			return conns.drain(ctx)
+		})
+	}
+	if cfg.MemcachedPort > 0 {
+		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.MemcachedPort))
+		if err != nil {
+			panic(err)
+		}
+		conns := new(connGroup)
+		go conns.serve(ln, "memcached", handleMemcachedConn)
+		// In-flight commands are answered before the database is closed
+		signal.OnShutdown("memcached server", func(ctx context.Context) error {
+			if err := ln.Close(); err != nil {
+				return err
+			}
+			return conns.drain(ctx)
+		})
+	}
 
-	server := httptools.CreateServer(*port, h)
+	server := httptools.CreateServerAt(cfg.addr(), serviceMetrics.instrument(authenticate(h)), cfg.TLSCert, cfg.TLSKey)
 	server.Start()
+	signal.OnShutdown("long polls", func(context.Context) error {
+		close(stopWaits)
+		return nil
+	})
+	// The database is closed after the requests using it are drained
+	signal.OnShutdown("HTTP server", server.Shutdown)
+	signal.OnShutdown("database", func(context.Context) error {
+		return db.Close()
+	})
+	if mutationLog != nil {
+		signal.OnShutdown("audit log", func(context.Context) error {
+			return mutationLog.Close()
+		})
+	}
 	signal.WaitForTerminationSignal()
 }
 
 func handleDb(rw http.ResponseWriter, r *http.Request) {
+	if cfg.OpTimeout > 0 && !isLongPoll(r) {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(cfg.OpTimeout))
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	key, perm := strings.TrimPrefix(r.URL.Path, "/db/"), permWrite
+	if r.Method == http.MethodGet {
+		perm = permRead
+	}
+	if key == "" {
+		switch r.Method {
+		case http.MethodGet:
+			// A listing of keys with the prefix
+			key = r.URL.Query().Get("prefix")
+		case http.MethodPost, http.MethodPut, http.MethodDelete:
+			writeError(rw, errMissingKey)
+			return
+		}
+	}
+	if !authorize(rw, r, perm, key) {
+		return
+	}
 	switch r.Method {
 	case http.MethodGet:
 		handleDbGet(rw, r)
 	case http.MethodPost:
 		handleDbPost(rw, r)
+	case http.MethodPut:
+		handleDbPut(rw, r)
+	case http.MethodDelete:
+		handleDbDelete(rw, r)
 	default:
-		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(rw, http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete)
 	}
 }
 
 func handleDbGet(rw http.ResponseWriter, r *http.Request) {
 	key := strings.TrimPrefix(r.URL.Path, "/db/")
+	if key == "" {
+		handleDbList(rw, r)
+		return
+	}
+	if r.URL.Query().Has("history") {
+		handleDbHistory(rw, key)
+		return
+	}
+	if wantsStream(r) {
+		handleDbGetStream(rw, key)
+		return
+	}
 	t := r.URL.Query().Get("type")
-	getter := typeToGetter(t)
-	if getter == nil {
-		http.Error(rw, "Unknown data type", http.StatusBadRequest)
+	if t == "" {
+		t = "string"
+	}
+	if t != "string" && t != "int64" {
+		writeError(rw, errUnknownType)
 		return
 	}
-	data, err := getter(key)
-
-	if err != nil {
-		http.Error(rw, err.Error(), http.StatusBadRequest)
+	var v datastore.Version
+	var err error
+	if isLongPoll(r) {
+		var after uint64
+		v, after, err = waitLatest(rw, r, key)
+		if err == errNotChanged {
+			writeNotChanged(rw, after)
+			return
+		}
 	} else {
-		_ = json.NewEncoder(rw).Encode(data)
+		v, err = db.LatestContext(r.Context(), key)
 	}
+	if err == nil && v.Type != t {
+		err = &datastore.WrongTypeError{Expected: t, Actual: v.Type}
+	}
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	rw.Header().Set("etag", etag(v.Seq))
+	if notModified(r, v.Seq) {
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+	data := struct {
+		Key   string      `json:"key"`
+		Value interface{} `json:"value"`
+	}{key, v.Value}
+	if t == "int64" {
+		data.Value = json.Number(v.Value)
+	}
+	rw.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(rw).Encode(data)
 }
 
-func typeToGetter(t string) func(string) (interface{}, error) {
-	if t == "" || t == "string" {
-		return get
-	} else if t == "int64" {
-		return getInt64
-	} else {
-		return nil
+// handleDbList lists the keys starting with the prefix parameter in ascending order, a page at a time.
+// The cursor returned with a page, if any, is passed to get the next one.
+// With values=true the response has the values and types of the keys as well.
+func handleDbList(rw http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix, after := query.Get("prefix"), ""
+	if cursor := query.Get("cursor"); cursor != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			writeErrorStatus(rw, http.StatusUnprocessableEntity, "invalid_cursor", "Invalid cursor")
+			return
+		}
+		after = string(decoded)
+	}
+	limit := defaultListLimit
+	if query.Has("limit") {
+		n, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || n < 1 || n > maxListLimit {
+			writeErrorStatus(rw, http.StatusUnprocessableEntity, "invalid_value",
+				fmt.Sprintf("limit has to be a number from 1 to %d", maxListLimit))
+			return
+		}
+		limit = n
 	}
-}
 
-func get(key string) (interface{}, error) {
-	value, err := db.Get(key)
-	if err != nil {
-		return nil, err
+	keys := db.Keys()
+	start := sort.SearchStrings(keys, prefix)
+	if after >= prefix {
+		// The first key after the one the previous page ended with
+		start = sort.Search(len(keys), func(i int) bool { return keys[i] > after })
 	}
 	data := struct {
-		Key   string `json:"key"`
-		Value string `json:"value"`
-	}{key, value}
-	return data, nil
+		Keys    []string    `json:"keys"`
+		Entries []mgetEntry `json:"entries,omitempty"`
+		Cursor  string      `json:"cursor,omitempty"`
+	}{Keys: make([]string, 0)}
+	for _, key := range keys[start:] {
+		if !strings.HasPrefix(key, prefix) {
+			break
+		}
+		if isMemcachedMeta(key) {
+			continue
+		}
+		if len(data.Keys) == limit {
+			data.Cursor = base64.RawURLEncoding.EncodeToString([]byte(data.Keys[limit-1]))
+			break
+		}
+		data.Keys = append(data.Keys, key)
+	}
+	if query.Get("values") == "true" {
+		data.Entries = make([]mgetEntry, 0, len(data.Keys))
+		for _, key := range data.Keys {
+			value, vType, err := db.LookupContext(r.Context(), key)
+			if errors.Is(err, datastore.ErrNotFound) {
+				// Deleted since the keys were listed
+				continue
+			}
+			if err != nil {
+				writeError(rw, err)
+				return
+			}
+			data.Entries = append(data.Entries, newMgetEntry(key, vType, value))
+		}
+	}
+	rw.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(rw).Encode(data)
+}
+
+type version struct {
+	Seq       uint64    `json:"seq"`
+	Timestamp time.Time `json:"timestamp"`
+	Type      string    `json:"type"`
+	Value     string    `json:"value"`
 }
 
-func getInt64(key string) (interface{}, error) {
-	value, err := db.GetInt64(key)
+func handleDbHistory(rw http.ResponseWriter, key string) {
+	history, err := db.History(key)
 	if err != nil {
-		return nil, err
+		writeError(rw, err)
+		return
 	}
 	data := struct {
-		Key   string `json:"key"`
-		Value int64  `json:"value"`
-	}{key, value}
-	return data, nil
+		Key      string    `json:"key"`
+		Versions []version `json:"versions"`
+	}{Key: key}
+	for _, v := range history {
+		data.Versions = append(data.Versions, version(v))
+	}
+	_ = json.NewEncoder(rw).Encode(data)
 }
 
 func handleDbPost(rw http.ResponseWriter, r *http.Request) {
 	key := strings.TrimPrefix(r.URL.Path, "/db/")
+	if r.Header.Get("content-type") == streamContentType {
+		handleDbPostStream(rw, r, key)
+		return
+	}
 	value := r.FormValue("value")
 	t := r.URL.Query().Get("type")
 	putter := typeToPutter(t)
 	if putter == nil {
-		http.Error(rw, "Unknown data type", http.StatusBadRequest)
+		writeError(rw, errUnknownType)
 		return
 	}
-	err := putter(key, value)
+	cond, err := writeCondition(r)
+	if err == nil {
+		var seq uint64
+		seq, err = putter(r.Context(), key, value, cond)
+		rw.Header().Set("etag", etag(seq))
+	}
 	if err != nil {
-		http.Error(rw, err.Error(), http.StatusBadRequest)
+		rw.Header().Del("etag")
+		writeError(rw, err)
+		return
 	}
+	auditChange(r, "put", key, value)
 }
 
-func typeToPutter(t string) func(string, string) error {
+// handleDbPut stores a value sent as JSON, such as {"value": "text"} or {"type": "int64", "value": 42}.
+// The type can also be given with the type parameter, like for POST.
+func handleDbPut(rw http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/db/")
+	if r.Header.Get("content-type") == streamContentType {
+		handleDbPostStream(rw, r, key)
+		return
+	}
+	var body struct {
+		Type  string          `json:"type"`
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeErrorStatus(rw, http.StatusBadRequest, "bad_request", "Malformed JSON body: "+err.Error())
+		return
+	}
+	if body.Type == "" {
+		body.Type = r.URL.Query().Get("type")
+	}
+	putter := typeToPutter(body.Type)
+	if putter == nil {
+		writeError(rw, errUnknownType)
+		return
+	}
+	value, err := jsonValueText(body.Type, body.Value)
+	var cond datastore.Condition
+	if err == nil {
+		cond, err = writeCondition(r)
+	}
+	var seq uint64
+	if err == nil {
+		seq, err = putter(r.Context(), key, value, cond)
+	}
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	auditChange(r, "put", key, value)
+	rw.Header().Set("etag", etag(seq))
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// jsonValueText converts a JSON value to the text taken by putters.
+// int64 values can be sent both as numbers and as strings holding them.
+func jsonValueText(t string, raw json.RawMessage) (string, error) {
+	if len(raw) == 0 {
+		return "", errMissingValue
+	}
+	if t == "int64" {
+		var n json.Number
+		if err := json.Unmarshal(raw, &n); err != nil {
+			return "", errConvertType
+		}
+		return n.String(), nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return "", errConvertType
+	}
+	return s, nil
+}
+
+func handleDbDelete(rw http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/db/")
+	cond, err := writeCondition(r)
+	if err == nil {
+		err = db.DeleteIfContext(r.Context(), key, cond)
+	}
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	auditChange(r, "delete", key, "")
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// typeToPutter returns the function storing a value of the type given as text if the key meets the condition.
+// It returns the sequence number of the new version.
+func typeToPutter(t string) func(context.Context, string, string, datastore.Condition) (uint64, error) {
 	if t == "" || t == "string" {
 		return put
 	} else if t == "int64" {
@@ -119,17 +418,32 @@ func typeToPutter(t string) func(string, string) error {
 	}
 }
 
-func put(key, value string) error {
+var (
+	errEmptyValue   = errors.New("Can't save empty value")
+	errMissingValue = errors.New("Value is missing")
+	errMissingKey   = errors.New("Key is missing")
+	errConvertType  = errors.New("Can't convert value to the given type")
+	errUnknownType  = errors.New("Unknown data type")
+	errInvalidOp    = errors.New("Invalid operation")
+)
+
+const (
+	// Keys listed in a page unless the limit parameter says otherwise
+	defaultListLimit = 1000
+	maxListLimit     = 10000
+)
+
+func put(ctx context.Context, key, value string, cond datastore.Condition) (uint64, error) {
 	if value == "" {
-		return fmt.Errorf("Can't save empty value")
+		return 0, errEmptyValue
 	}
-	return db.Put(key, value)
+	return db.PutIfContext(ctx, key, value, cond)
 }
 
-func putInt64(key, value string) error {
+func putInt64(ctx context.Context, key, value string, cond datastore.Condition) (uint64, error) {
 	i, err := strconv.ParseInt(value, 10, 64)
 	if err != nil {
-		return fmt.Errorf("Can't convert value to the given type")
+		return 0, errConvertType
 	}
-	return db.PutInt64(key, i)
+	return db.PutInt64IfContext(ctx, key, i, cond)
 }
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+func TestHandleDb(t *testing.T) {
+	newDb, err := datastore.NewDb("db", datastore.WithFS(datastore.NewMemFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newDb.Close()
+	db = newDb
+
+	do := func(method, target, contentType, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if contentType != "" {
+			r.Header.Set("content-type", contentType)
+		}
+		rw := httptest.NewRecorder()
+		handleDb(rw, r)
+		return rw
+	}
+
+	for _, tc := range []struct {
+		name, method, target, contentType, body string
+		status                                  int
+		code                                    string
+	}{
+		{"put string", "PUT", "/db/key", "application/json", `{"value": "text"}`, http.StatusNoContent, ""},
+		{"put int64", "PUT", "/db/counter", "application/json", `{"type": "int64", "value": 42}`, http.StatusNoContent, ""},
+		{"put int64 as string", "PUT", "/db/counter2?type=int64", "application/json", `{"value": "7"}`, http.StatusNoContent, ""},
+		{"post form", "POST", "/db/form", "application/x-www-form-urlencoded", "value=old", http.StatusOK, ""},
+		{"get", "GET", "/db/key", "", "", http.StatusOK, ""},
+		{"get missing", "GET", "/db/missing", "", "", http.StatusNotFound, "not_found"},
+		{"get wrong type", "GET", "/db/key?type=int64", "", "", http.StatusConflict, "wrong_type"},
+		{"unknown type", "GET", "/db/key?type=float", "", "", http.StatusUnprocessableEntity, "invalid_value"},
+		{"put not a number", "PUT", "/db/counter", "application/json", `{"type": "int64", "value": 4.5}`, http.StatusUnprocessableEntity, "invalid_value"},
+		{"put missing value", "PUT", "/db/key", "application/json", `{"type": "string"}`, http.StatusUnprocessableEntity, "invalid_value"},
+		{"post empty value", "POST", "/db/key", "application/x-www-form-urlencoded", "value=", http.StatusUnprocessableEntity, "invalid_value"},
+		{"put malformed", "PUT", "/db/key", "application/json", `{"value": `, http.StatusBadRequest, "bad_request"},
+		{"delete", "DELETE", "/db/form", "", "", http.StatusNoContent, ""},
+		{"delete missing", "DELETE", "/db/form", "", "", http.StatusNotFound, "not_found"},
+		{"method", "PATCH", "/db/key", "", "", http.StatusMethodNotAllowed, "method_not_allowed"},
+	} {
+		rw := do(tc.method, tc.target, tc.contentType, tc.body)
+		if rw.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d: %s", tc.name, tc.status, rw.Code, rw.Body)
+			continue
+		}
+		if tc.code == "" {
+			continue
+		}
+		var body apiError
+		if err := json.Unmarshal(rw.Body.Bytes(), &body); err != nil || body.Code != tc.code || body.Message == "" {
+			t.Errorf("%s: expected error code %s, got %s", tc.name, tc.code, rw.Body)
+		}
+	}
+
+	if value, err := db.Get("key"); err != nil || value != "text" {
+		t.Errorf("Bad value of key [%s]: %v", value, err)
+	}
+	for key, expected := range map[string]int64{"counter": 42, "counter2": 7} {
+		if n, err := db.GetInt64(key); err != nil || n != expected {
+			t.Errorf("Bad value of %s [%d]: %v", key, n, err)
+		}
+	}
+	rw := do("GET", "/db/?prefix=counter", "", "")
+	var list struct{ Keys []string }
+	if err := json.Unmarshal(rw.Body.Bytes(), &list); err != nil || !reflect.DeepEqual(list.Keys, []string{"counter", "counter2"}) {
+		t.Errorf("Unexpected list of keys %s: %v", rw.Body, err)
+	}
+
+	rw = do("GET", "/db/key", "", "")
+	var data struct{ Key, Value string }
+	if err := json.Unmarshal(rw.Body.Bytes(), &data); err != nil || data.Value != "text" {
+		t.Errorf("Unexpected response %s: %v", rw.Body, err)
+	}
+}
+
+func TestHandleDbList(t *testing.T) {
+	newDb, err := datastore.NewDb("db", datastore.WithFS(datastore.NewMemFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newDb.Close()
+	db = newDb
+	for _, key := range []string{"a", "b/1", "b/2", "b/3", "c"} {
+		if err := db.Put(key, "value of "+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.PutInt64("b/4", 4); err != nil {
+		t.Fatal(err)
+	}
+
+	type page struct {
+		Keys    []string
+		Entries []mgetEntry
+		Cursor  string
+	}
+	list := func(query string) page {
+		rw := httptest.NewRecorder()
+		handleDb(rw, httptest.NewRequest("GET", "/db/?"+query, nil))
+		if rw.Code != http.StatusOK {
+			t.Fatalf("Unexpected status %d: %s", rw.Code, rw.Body)
+		}
+		var p page
+		if err := json.Unmarshal(rw.Body.Bytes(), &p); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	var keys []string
+	cursor, pages := "", 0
+	for {
+		p := list("prefix=b/&limit=3&cursor=" + cursor)
+		keys, cursor, pages = append(keys, p.Keys...), p.Cursor, pages+1
+		if cursor == "" {
+			break
+		}
+	}
+	if expected := []string{"b/1", "b/2", "b/3", "b/4"}; !reflect.DeepEqual(keys, expected) || pages != 2 {
+		t.Errorf("Expected %v in 2 pages, got %v in %d", expected, keys, pages)
+	}
+
+	p := list("prefix=b/&limit=2&values=true&cursor=" + list("prefix=b/&limit=2").Cursor)
+	expected := []mgetEntry{{"b/3", "string", "value of b/3"}, {"b/4", "int64", float64(4)}}
+	if !reflect.DeepEqual(p.Entries, expected) || p.Cursor != "" {
+		t.Errorf("Expected the last page %v, got %+v", expected, p)
+	}
+
+	rw := httptest.NewRecorder()
+	handleDb(rw, httptest.NewRequest("GET", "/db/?cursor=***", nil))
+	if rw.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for an invalid cursor, got %d", rw.Code)
+	}
+}
+
+func TestHandleDbConditional(t *testing.T) {
+	newDb, err := datastore.NewDb("db", datastore.WithFS(datastore.NewMemFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newDb.Close()
+	db = newDb
+
+	do := func(method, target string, header map[string]string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		for name, value := range header {
+			r.Header.Set(name, value)
+		}
+		rw := httptest.NewRecorder()
+		handleDb(rw, r)
+		return rw
+	}
+	const value = `{"type":"string","value":"v"}`
+
+	rw := do("PUT", "/db/k", map[string]string{"If-None-Match": "*"}, value)
+	if rw.Code != http.StatusNoContent || rw.Header().Get("etag") == "" {
+		t.Fatalf("Unexpected status %d or no ETag: %s", rw.Code, rw.Body)
+	}
+	tag := rw.Header().Get("etag")
+	if rw := do("PUT", "/db/k", map[string]string{"If-None-Match": "*"}, value); rw.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 when the key exists, got %d", rw.Code)
+	}
+
+	rw = do("GET", "/db/k", nil, "")
+	if rw.Code != http.StatusOK || rw.Header().Get("etag") != tag {
+		t.Errorf("Expected ETag %s, got %d %s", tag, rw.Code, rw.Header().Get("etag"))
+	}
+	if rw := do("GET", "/db/k", map[string]string{"If-None-Match": `"0", W/` + tag}, ""); rw.Code != http.StatusNotModified || rw.Body.Len() != 0 {
+		t.Errorf("Expected 304 without a body, got %d", rw.Code)
+	}
+
+	rw = do("PUT", "/db/k", map[string]string{"If-Match": tag}, value)
+	if rw.Code != http.StatusNoContent || rw.Header().Get("etag") == tag {
+		t.Fatalf("Expected a new ETag, got %d %s", rw.Code, rw.Header().Get("etag"))
+	}
+	newTag := rw.Header().Get("etag")
+	// A lost update
+	if rw := do("PUT", "/db/k", map[string]string{"If-Match": tag}, value); rw.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for a stale ETag, got %d", rw.Code)
+	}
+	if rw := do("POST", "/db/k", map[string]string{"If-Match": tag, "content-type": "application/x-www-form-urlencoded"}, "value=v"); rw.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for a stale ETag of a form, got %d", rw.Code)
+	}
+	if rw := do("PUT", "/db/k", map[string]string{"If-Match": "v1"}, value); rw.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a malformed ETag, got %d", rw.Code)
+	}
+	if rw := do("DELETE", "/db/k", map[string]string{"If-Match": tag}, ""); rw.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 deleting a changed value, got %d", rw.Code)
+	}
+	if rw := do("DELETE", "/db/k", map[string]string{"If-Match": newTag}, ""); rw.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 deleting, got %d: %s", rw.Code, rw.Body)
+	}
+	if rw := do("PUT", "/db/k", map[string]string{"If-Match": "*"}, value); rw.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for a missing key, got %d", rw.Code)
+	}
+}
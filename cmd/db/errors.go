@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"syscall"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+// apiError is the body of every error response of the HTTP API.
+type apiError struct {
+	// Identifies the kind of error for programs, such as "not_found"
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// errorStatus chooses the HTTP status and the code reporting the error.
+func errorStatus(err error) (int, string) {
+	switch {
+	// Checked first, as a failed condition can also mean the key doesn't exist
+	case errors.Is(err, datastore.ErrConditionFailed):
+		return http.StatusPreconditionFailed, "precondition_failed"
+	case errors.Is(err, errBadPrecondition):
+		return http.StatusBadRequest, "bad_request"
+	case errors.Is(err, errForbidden):
+		return http.StatusForbidden, "forbidden"
+	case errors.Is(err, datastore.ErrNotFound):
+		return http.StatusNotFound, "not_found"
+	case errors.Is(err, datastore.ErrNoIndex):
+		return http.StatusNotFound, "no_index"
+	case errors.Is(err, datastore.ErrWrongType):
+		return http.StatusConflict, "wrong_type"
+	case errors.Is(err, errImportRunning):
+		return http.StatusConflict, "import_running"
+	case errors.Is(err, datastore.ErrKeyTooLarge):
+		return http.StatusRequestURITooLong, "key_too_large"
+	case errors.Is(err, datastore.ErrValueTooLarge):
+		return http.StatusRequestEntityTooLarge, "value_too_large"
+	case errors.Is(err, datastore.ErrQuotaExceeded), errors.Is(err, syscall.ENOSPC):
+		return http.StatusInsufficientStorage, "quota_exceeded"
+	case errors.Is(err, errEmptyValue), errors.Is(err, errMissingValue), errors.Is(err, errConvertType),
+		errors.Is(err, errUnknownType), errors.Is(err, errInvalidOp):
+		return http.StatusUnprocessableEntity, "invalid_value"
+	case errors.Is(err, datastore.ErrOverflow):
+		return http.StatusUnprocessableEntity, "overflow"
+	case errors.Is(err, errMissingKey):
+		return http.StatusUnprocessableEntity, "invalid_key"
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return http.StatusBadRequest, "bad_request"
+	case errors.Is(err, datastore.ErrClosed), errors.Is(err, datastore.ErrReadOnly):
+		return http.StatusServiceUnavailable, "unavailable"
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, "timeout"
+	case errors.Is(err, context.Canceled):
+		// Nobody reads the response of a cancelled request, but it shouldn't look like a server failure either
+		return http.StatusServiceUnavailable, "canceled"
+	default:
+		return http.StatusInternalServerError, "internal"
+	}
+}
+
+func writeError(rw http.ResponseWriter, err error) {
+	status, code := errorStatus(err)
+	writeErrorStatus(rw, status, code, err.Error())
+}
+
+func writeErrorStatus(rw http.ResponseWriter, status int, code, message string) {
+	// The content type may have been set for a successful response
+	rw.Header().Set("content-type", "application/json")
+	rw.Header().Set("x-content-type-options", "nosniff")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(apiError{code, message})
+}
+
+func writeMethodNotAllowed(rw http.ResponseWriter, allowed ...string) {
+	rw.Header().Set("allow", strings.Join(allowed, ", "))
+	writeErrorStatus(rw, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+}
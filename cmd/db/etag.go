@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+// Values are tagged with the sequence numbers of their versions, so an ETag changes with every write of the key.
+
+var errBadPrecondition = errors.New("If-Match and If-None-Match take a single ETag or *")
+
+func etag(seq uint64) string {
+	return `"` + strconv.FormatUint(seq, 10) + `"`
+}
+
+// parseETag returns the sequence number of the ETag. weak tells whether it is a weak one, W/"...".
+func parseETag(tag string) (seq uint64, weak bool, ok bool) {
+	tag = strings.TrimSpace(tag)
+	if strings.HasPrefix(tag, "W/") {
+		tag, weak = tag[2:], true
+	}
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return 0, false, false
+	}
+	seq, err := strconv.ParseUint(tag[1:len(tag)-1], 10, 64)
+	return seq, weak, err == nil
+}
+
+// notModified tells whether the If-None-Match header of a read matches the current version of the value.
+// Tags are compared weakly, as RFC 9110 requires for If-None-Match.
+func notModified(r *http.Request, seq uint64) bool {
+	header := r.Header.Get("if-none-match")
+	if header == "" {
+		return false
+	}
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimSpace(tag) == "*" {
+			return true
+		}
+		if s, _, ok := parseETag(tag); ok && s == seq {
+			return true
+		}
+	}
+	return false
+}
+
+// writeCondition turns the If-Match and If-None-Match headers of a write into the condition it is made with.
+// If-Match: "N" writes only over the version N, If-Match: * only over an existing value,
+// and If-None-Match: * only if the key has no value.
+func writeCondition(r *http.Request) (datastore.Condition, error) {
+	var cond datastore.Condition
+	if tag := r.Header.Get("if-match"); tag != "" {
+		if strings.TrimSpace(tag) == "*" {
+			cond.Exists = true
+		} else {
+			seq, weak, ok := parseETag(tag)
+			if !ok {
+				return cond, errBadPrecondition
+			}
+			if weak {
+				// Weak tags never match strongly, so the write can't happen
+				return cond, datastore.ErrConditionFailed
+			}
+			cond.Seq = seq
+		}
+	}
+	if tag := r.Header.Get("if-none-match"); tag != "" {
+		if strings.TrimSpace(tag) != "*" {
+			return cond, errBadPrecondition
+		}
+		cond.Missing = true
+	}
+	return cond, nil
+}
+
+// conditional tells whether the request has preconditions.
+func conditional(r *http.Request) bool {
+	return r.Header.Get("if-match") != "" || r.Header.Get("if-none-match") != ""
+}
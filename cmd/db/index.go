@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+// indexFlags collects secondary indexes declared with repeated -index flags.
+type indexFlags []datastore.Index
+
+func (f *indexFlags) String() string {
+	specs := make([]string, len(*f))
+	for i, idx := range *f {
+		specs[i] = idx.Name + ":" + idx.Prefix + ":" + idx.Path
+	}
+	return strings.Join(specs, ",")
+}
+
+func (f *indexFlags) Set(s string) error {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+		return fmt.Errorf("expected name:prefix:path, got %q", s)
+	}
+	*f = append(*f, datastore.Index{Name: parts[0], Prefix: parts[1], Path: parts[2]})
+	return nil
+}
+
+// ensureIndexes makes the declared indexes of the database match the flags.
+// Indexes declared earlier but missing from the flags are kept.
+func ensureIndexes(db *datastore.Db, indexes []datastore.Index) error {
+	existing := make(map[string]datastore.Index)
+	for _, idx := range db.Indexes() {
+		existing[idx.Name] = idx
+	}
+	for _, idx := range indexes {
+		old, ok := existing[idx.Name]
+		if ok && old == idx {
+			continue
+		}
+		if ok {
+			if err := db.DropIndex(idx.Name); err != nil {
+				return err
+			}
+		}
+		if err := db.CreateIndex(idx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func handleFind(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(rw, http.MethodGet)
+		return
+	}
+	query := r.URL.Query()
+	index, value := query.Get("index"), query.Get("value")
+	if index == "" || !query.Has("value") {
+		writeErrorStatus(rw, http.StatusUnprocessableEntity, "invalid_value", "index and value are required")
+		return
+	}
+	keys, err := db.FindBy(index, value)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	// Keys the token can't read are left out
+	readable := keys[:0]
+	for _, key := range keys {
+		if allowed(r, permRead, key) {
+			readable = append(readable, key)
+		}
+	}
+	keys = readable
+	data := struct {
+		Index string   `json:"index"`
+		Value string   `json:"value"`
+		Keys  []string `json:"keys"`
+	}{index, value, keys}
+	_ = json.NewEncoder(rw).Encode(data)
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+// The listener started with -memcached-port speaks the memcached text protocol:
+// https://github.com/memcached/memcached/blob/master/doc/protocol.txt
+// Values are stored by their keys as strings, so they are shared with the HTTP API and RESP.
+// Non-zero flags and expiration times are kept by a companion key under memcachedMetaPrefix
+// together with the sequence number of the value they belong to, so a value written
+// through another API is not affected by them.
+
+const memcachedMetaPrefix = "_memcached/"
+
+// The longest key memcached accepts
+const mcMaxKeySize = 250
+
+// isMemcachedMeta tells whether the key holds the flags of a memcached item rather than a value.
+// Such keys are left out of listings and exports.
+func isMemcachedMeta(key string) bool {
+	return strings.HasPrefix(key, memcachedMetaPrefix)
+}
+
+// mcCheckKeys returns an error reply if a key is too long for memcached or, with the prefix
+// of its flags, for the database.
+func mcCheckKeys(keys []string) string {
+	for _, key := range keys {
+		if len(key) > mcMaxKeySize || int64(len(memcachedMetaPrefix+key)) > cfg.MaxKeySize {
+			return "CLIENT_ERROR key is too long"
+		}
+	}
+	return ""
+}
+
+// Expiration times up to 30 days are relative to now, longer ones are Unix times
+const maxRelativeExptime = 60 * 60 * 24 * 30
+
+// mcItem is a value as memcached clients see it.
+type mcItem struct {
+	value string
+	// The type of the stored value, int64 values are changed by incr and decr as numbers
+	vType string
+	flags uint32
+	// Unix time the item expires at, 0 if never
+	expires int64
+	// The sequence number of the value, used as the cas unique
+	cas uint64
+}
+
+type mcConn struct {
+	r    *bufio.Reader
+	w    *bufio.Writer
+	addr string
+}
+
+func handleMemcachedConn(conn net.Conn) {
+	defer conn.Close()
+	c := &mcConn{bufio.NewReader(conn), bufio.NewWriter(conn), conn.RemoteAddr().String()}
+	for {
+		line, err := readLine(c.r)
+		if err != nil {
+			if err == errLineTooLong {
+				c.w.WriteString("CLIENT_ERROR line is too long\r\n")
+				c.w.Flush()
+			}
+			return
+		}
+		quit := false
+		if args := strings.Fields(line); len(args) == 0 {
+			c.w.WriteString("ERROR\r\n")
+		} else if quit, err = c.exec(args); err != nil {
+			c.w.Flush()
+			return
+		}
+		// Replies to pipelined commands are sent together
+		if c.r.Buffered() == 0 || quit {
+			if err := c.w.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// exec runs the command and writes its reply. It returns true if the connection has to be closed,
+// and an error if the data block of a storage command can't be read.
+func (c *mcConn) exec(args []string) (bool, error) {
+	noreply := false
+	if n := len(args); n > 1 && args[n-1] == "noreply" {
+		noreply, args = true, args[:n-1]
+	}
+	var reply string
+	switch args[0] {
+	case "get", "gets":
+		if len(args) < 2 {
+			reply = "ERROR"
+			break
+		}
+		if reply = mcCheckKeys(args[1:]); reply != "" {
+			break
+		}
+		for _, key := range args[1:] {
+			item, found, err := mcGet(key)
+			if err != nil {
+				reply = serverError(err)
+				break
+			}
+			if !found {
+				continue
+			}
+			fmt.Fprintf(c.w, "VALUE %s %d %d", key, item.flags, len(item.value))
+			if args[0] == "gets" {
+				fmt.Fprintf(c.w, " %d", item.cas)
+			}
+			c.w.WriteString("\r\n" + item.value + "\r\n")
+		}
+		if reply == "" {
+			reply = "END"
+		}
+		noreply = false
+	case "set", "add", "replace", "cas":
+		var err error
+		if reply, err = c.store(args); err != nil {
+			return false, err
+		}
+	case "delete":
+		if len(args) != 2 {
+			reply = "ERROR"
+		} else if reply = mcCheckKeys(args[1:]); reply == "" {
+			if reply = mcDelete(args[1]); reply == "DELETED" {
+				c.audit("delete", args[1], "")
+			}
+		}
+	case "incr", "decr":
+		if len(args) != 3 {
+			reply = "ERROR"
+		} else if reply = mcCheckKeys(args[1:2]); reply == "" {
+			if reply = mcIncr(args[1], args[2], args[0] == "decr"); isDigits(reply) {
+				c.audit("incr", args[1], reply)
+			}
+		}
+	case "version":
+		reply, noreply = "VERSION 1.6.0", false
+	case "quit":
+		return true, nil
+	default:
+		reply, noreply = "ERROR", false
+	}
+	if !noreply {
+		c.w.WriteString(reply + "\r\n")
+	}
+	return false, nil
+}
+
+// store handles <command> <key> <flags> <exptime> <bytes> [<cas unique>] followed by a data block.
+func (c *mcConn) store(args []string) (string, error) {
+	n := 5
+	if args[0] == "cas" {
+		n = 6
+	}
+	if len(args) != n {
+		return "ERROR", nil
+	}
+	flags, err1 := strconv.ParseUint(args[2], 10, 32)
+	exptime, err2 := strconv.ParseInt(args[3], 10, 64)
+	size, err3 := strconv.ParseInt(args[4], 10, 64)
+	var cas uint64
+	var err4 error
+	if args[0] == "cas" {
+		cas, err4 = strconv.ParseUint(args[5], 10, 64)
+	}
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || size < 0 || (args[0] == "cas" && cas == 0) {
+		return "CLIENT_ERROR bad command line format", nil
+	}
+	if size > cfg.MaxValueSize {
+		if _, err := io.CopyN(io.Discard, c.r, size+2); err != nil {
+			return "", err
+		}
+		return "SERVER_ERROR object too large for cache", nil
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return "", err
+	}
+	if string(data[size:]) != "\r\n" {
+		return "CLIENT_ERROR bad data chunk", nil
+	}
+	// Checked after the data block is read, so it isn't taken for a command
+	if reply := mcCheckKeys(args[1:2]); reply != "" {
+		return reply, nil
+	}
+
+	key, value := args[1], string(data[:size])
+	// An expired item is deleted first, so add can store it and replace and cas can't
+	if _, _, err := mcGet(key); err != nil {
+		return serverError(err), nil
+	}
+	var cond datastore.Condition
+	switch args[0] {
+	case "add":
+		cond.Missing = true
+	case "replace":
+		cond.Exists = true
+	case "cas":
+		cond.Seq = cas
+	}
+	err := mcPut(key, mcItem{value: value, flags: uint32(flags), expires: mcExpires(exptime, time.Now())}, cond)
+	switch {
+	case err == nil:
+		c.audit("put", key, value)
+		return "STORED", nil
+	case args[0] == "cas" && errors.Is(err, datastore.ErrNotFound):
+		return "NOT_FOUND", nil
+	case args[0] == "cas" && errors.Is(err, datastore.ErrConditionFailed):
+		return "EXISTS", nil
+	case errors.Is(err, datastore.ErrConditionFailed):
+		return "NOT_STORED", nil
+	}
+	return serverError(err), nil
+}
+
+// mcExpires converts an exptime of the protocol to a Unix time. Negative ones mean the item is already expired.
+func mcExpires(exptime int64, now time.Time) int64 {
+	switch {
+	case exptime == 0:
+		return 0
+	case exptime < 0:
+		return 1
+	case exptime <= maxRelativeExptime:
+		return now.Unix() + exptime
+	}
+	return exptime
+}
+
+// mcGet returns the item stored by the key. An expired item is deleted and reported as missing.
+func mcGet(key string) (mcItem, bool, error) {
+	v, err := db.Latest(key)
+	if errors.Is(err, datastore.ErrNotFound) {
+		return mcItem{}, false, nil
+	}
+	if err != nil {
+		return mcItem{}, false, err
+	}
+	item := mcItem{value: v.Value, vType: v.Type, cas: v.Seq}
+	meta, err := db.Get(memcachedMetaPrefix + key)
+	if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+		return mcItem{}, false, err
+	}
+	var seq uint64
+	if _, err := fmt.Sscan(meta, &item.flags, &item.expires, &seq); err != nil || seq != v.Seq {
+		// The value was written without flags or expiration time
+		item.flags, item.expires = 0, 0
+	}
+	if item.expires != 0 && item.expires <= time.Now().Unix() {
+		// Unless it has been overwritten since
+		err := db.DeleteIf(key, datastore.Condition{Seq: v.Seq})
+		if err != nil && !errors.Is(err, datastore.ErrNotFound) && !errors.Is(err, datastore.ErrConditionFailed) {
+			return mcItem{}, false, err
+		}
+		return mcItem{}, false, nil
+	}
+	return item, true, nil
+}
+
+// mcPut stores the value of the item if the key meets cond, and then its flags and expiration time.
+func mcPut(key string, item mcItem, cond datastore.Condition) error {
+	seq, err := db.PutIf(key, item.value, cond)
+	if err != nil {
+		return err
+	}
+	metaKey := memcachedMetaPrefix + key
+	if item.flags == 0 && item.expires == 0 {
+		if err := db.Delete(metaKey); err != nil && !errors.Is(err, datastore.ErrNotFound) {
+			return err
+		}
+		return nil
+	}
+	return db.Put(metaKey, fmt.Sprintf("%d %d %d", item.flags, item.expires, seq))
+}
+
+func mcDelete(key string) string {
+	_, found, err := mcGet(key)
+	if err != nil {
+		return serverError(err)
+	}
+	if !found {
+		return "NOT_FOUND"
+	}
+	if err := db.Delete(key); errors.Is(err, datastore.ErrNotFound) {
+		return "NOT_FOUND"
+	} else if err != nil {
+		return serverError(err)
+	}
+	if err := db.Delete(memcachedMetaPrefix + key); err != nil && !errors.Is(err, datastore.ErrNotFound) {
+		return serverError(err)
+	}
+	return "DELETED"
+}
+
+// mcIncr changes a decimal value by delta. Like in memcached, increments wrap around 64 bits
+// and decrements stop at 0. int64 values are changed with IncrBy instead and can go negative.
+func mcIncr(key, arg string, decr bool) string {
+	delta, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil {
+		return "CLIENT_ERROR invalid numeric delta argument"
+	}
+	for {
+		item, found, err := mcGet(key)
+		if err != nil {
+			return serverError(err)
+		}
+		if !found {
+			return "NOT_FOUND"
+		}
+		if item.vType == "int64" {
+			if delta > math.MaxInt64 {
+				return "CLIENT_ERROR invalid numeric delta argument"
+			}
+			d := int64(delta)
+			if decr {
+				d = -d
+			}
+			n, err := db.IncrBy(key, d)
+			if err != nil {
+				return serverError(err)
+			}
+			return strconv.FormatInt(n, 10)
+		}
+		n, err := strconv.ParseUint(item.value, 10, 64)
+		if err != nil {
+			return "CLIENT_ERROR cannot increment or decrement non-numeric value"
+		}
+		switch {
+		case !decr:
+			n += delta
+		case delta > n:
+			n = 0
+		default:
+			n -= delta
+		}
+		item.value = strconv.FormatUint(n, 10)
+		err = mcPut(key, item, datastore.Condition{Seq: item.cas})
+		if errors.Is(err, datastore.ErrConditionFailed) {
+			// Changed by another client since it was read
+			continue
+		}
+		if err != nil {
+			return serverError(err)
+		}
+		return item.value
+	}
+}
+
+// audit records a change made by the connection. The protocol has no authentication.
+func (c *mcConn) audit(op, key, value string) {
+	audit(newAuditRecord("memcached", c.addr, "anonymous", op, key, value))
+}
+
+// isDigits tells whether the reply of incr or decr is the new value rather than an error.
+func isDigits(s string) bool {
+	return s != "" && strings.Trim(s, "0123456789") == ""
+}
+
+func serverError(err error) string {
+	// Error replies are single lines
+	return "SERVER_ERROR " + strings.ReplaceAll(err.Error(), "\n", " ")
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+func TestMemcached(t *testing.T) {
+	newDb, err := datastore.NewDb("db", datastore.WithFS(datastore.NewMemFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newDb.Close()
+	db = newDb
+	if err := db.PutInt64("int", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleMemcachedConn(server)
+
+	// Longer than memcached allows
+	long := strings.Repeat("k", mcMaxKeySize+1)
+	// The value of key1 gets sequence number 2, and its flags 3
+	requests := "set key1 5 0 5\r\nvalue\r\n" +
+		"gets key1 missing\r\n" +
+		"add key1 0 0 1\r\nx\r\n" +
+		"replace missing 0 0 1\r\nx\r\n" +
+		"cas key1 0 0 3 3\r\nnew\r\n" +
+		"cas key1 0 0 3 2\r\nnew\r\n" +
+		"cas missing 0 0 1 1\r\nx\r\n" +
+		"get key1\r\n" +
+		"set counter 0 0 2 noreply\r\n10\r\n" +
+		"incr counter 5\r\n" +
+		"decr counter 20\r\n" +
+		"incr key1 1\r\n" +
+		"decr int 3\r\n" +
+		"set gone 0 -1 1\r\nx\r\n" +
+		"get gone\r\n" +
+		"replace gone 0 0 1\r\ny\r\n" +
+		"add gone 0 0 1\r\ny\r\n" +
+		"delete key1\r\n" +
+		"delete key1\r\n" +
+		"set flagged 7 0 1\r\nx\r\n" +
+		"set " + long + " 0 0 1\r\nx\r\n" +
+		"get key1 " + long + "\r\n" +
+		"bogus\r\n"
+	expected := "STORED\r\n" +
+		"VALUE key1 5 5 2\r\nvalue\r\nEND\r\n" +
+		"NOT_STORED\r\n" +
+		"NOT_STORED\r\n" +
+		"EXISTS\r\n" +
+		"STORED\r\n" +
+		"NOT_FOUND\r\n" +
+		"VALUE key1 0 3\r\nnew\r\nEND\r\n" +
+		"15\r\n" +
+		"0\r\n" +
+		"CLIENT_ERROR cannot increment or decrement non-numeric value\r\n" +
+		"-2\r\n" +
+		"STORED\r\n" +
+		"END\r\n" +
+		"NOT_STORED\r\n" +
+		"STORED\r\n" +
+		"DELETED\r\n" +
+		"NOT_FOUND\r\n" +
+		"STORED\r\n" +
+		"CLIENT_ERROR key is too long\r\n" +
+		"CLIENT_ERROR key is too long\r\n" +
+		"ERROR\r\n"
+
+	go func() {
+		io.WriteString(client, requests)
+	}()
+	reply := make([]byte, len(expected))
+	if _, err := io.ReadFull(bufio.NewReader(client), reply); err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != expected {
+		t.Errorf("Unexpected replies:\n%s\nexpected:\n%s", reply, expected)
+	}
+	if value, err := db.Get("counter"); err != nil || value != "0" {
+		t.Errorf("Bad value of the counter [%s]: %v", value, err)
+	}
+
+	// The flags of items are kept apart from the values of other APIs
+	rw := httptest.NewRecorder()
+	handleDbList(rw, httptest.NewRequest("GET", "/db/", nil))
+	if list := rw.Body.String(); strings.Contains(list, memcachedMetaPrefix) || !strings.Contains(list, `"flagged"`) {
+		t.Errorf("Unexpected listing %s", list)
+	}
+	rw = httptest.NewRecorder()
+	handleExport(rw, httptest.NewRequest("GET", "/db/_export", nil))
+	if export := rw.Body.String(); strings.Contains(export, memcachedMetaPrefix) || !strings.Contains(export, `"flagged"`) {
+		t.Errorf("Unexpected export %s", export)
+	}
+}
+
+func TestMemcachedEmptyLine(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleMemcachedConn(server)
+
+	go io.WriteString(client, "\r\n")
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	reply, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil || reply != "ERROR\r\n" {
+		t.Errorf("Unexpected reply %q: %v", reply, err)
+	}
+}
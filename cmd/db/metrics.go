@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+// /metrics exposes the metrics of the service in the Prometheus text format:
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+
+// Upper bounds in seconds of the latency histogram buckets
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram counts observed durations by buckets, like a Prometheus histogram.
+type histogram struct {
+	// Not cumulative, the count of the last one is of the values above all bounds
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	s := d.Seconds()
+	i := sort.SearchFloat64s(latencyBuckets, s)
+	h.counts[i]++
+	h.sum += s
+	h.count++
+}
+
+// write writes the series of the histogram with the labels, which are either empty or end with a comma.
+func (h *histogram) write(w io.Writer, name, labels string) {
+	var cumulative uint64
+	for i, bound := range latencyBuckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", name, labels, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, h.count)
+	labels = trimLabels(labels)
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+// trimLabels turns the labels written before le into a label set of their own.
+func trimLabels(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels[:len(labels)-1] + "}"
+}
+
+type requestKey struct {
+	method string
+	status int
+}
+
+type opKey struct {
+	op     datastore.Op
+	failed bool
+}
+
+// metrics collects the latencies of HTTP requests and of datastore operations.
+type metrics struct {
+	mu       sync.Mutex
+	requests map[requestKey]*histogram
+	ops      map[opKey]*histogram
+}
+
+var serviceMetrics = newMetrics()
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests: make(map[requestKey]*histogram),
+		ops:      make(map[opKey]*histogram),
+	}
+}
+
+func (m *metrics) observeRequest(method string, status int, d time.Duration) {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete:
+	default:
+		// Arbitrary methods would make arbitrary series
+		method = "other"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := requestKey{method, status}
+	if m.requests[key] == nil {
+		m.requests[key] = newHistogram()
+	}
+	m.requests[key].observe(d)
+}
+
+// observeOp is the datastore.Observer of the service.
+func (m *metrics) observeOp(op datastore.Op, d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := opKey{op, err != nil}
+	if m.ops[key] == nil {
+		m.ops[key] = newHistogram()
+	}
+	m.ops[key].observe(d)
+}
+
+// instrument records the method, status and latency of every request handled by h.
+func (m *metrics) instrument(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: rw, status: http.StatusOK}
+		h.ServeHTTP(sr, r)
+		m.observeRequest(r.Method, sr.status, time.Since(start))
+	})
+}
+
+// statusRecorder remembers the status of the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if !sr.wroteHeader {
+		sr.status, sr.wroteHeader = status, true
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(data []byte) (int, error) {
+	sr.wroteHeader = true
+	return sr.ResponseWriter.Write(data)
+}
+
+// Unwrap lets http.ResponseController reach the features of the original writer, such as flushing.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// write writes all metrics, with the gauges describing the current state of the datastore.
+func (m *metrics) write(w io.Writer, stats datastore.Stats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP db_http_requests_total HTTP requests by method and status.")
+	fmt.Fprintln(w, "# TYPE db_http_requests_total counter")
+	requests := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		requests = append(requests, key)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		if requests[i].method != requests[j].method {
+			return requests[i].method < requests[j].method
+		}
+		return requests[i].status < requests[j].status
+	})
+	for _, key := range requests {
+		fmt.Fprintf(w, "db_http_requests_total{method=%q,status=\"%d\"} %d\n", key.method, key.status, m.requests[key].count)
+	}
+	fmt.Fprintln(w, "# HELP db_http_request_duration_seconds Latency of HTTP requests by method and status.")
+	fmt.Fprintln(w, "# TYPE db_http_request_duration_seconds histogram")
+	for _, key := range requests {
+		m.requests[key].write(w, "db_http_request_duration_seconds", fmt.Sprintf("method=%q,status=\"%d\",", key.method, key.status))
+	}
+
+	// Merges and the time writes wait for the writer are operations too
+	fmt.Fprintln(w, "# HELP db_operation_duration_seconds Duration of datastore operations: get, put, queue (wait for the writer), merge and sync.")
+	fmt.Fprintln(w, "# TYPE db_operation_duration_seconds histogram")
+	ops := make([]opKey, 0, len(m.ops))
+	for key := range m.ops {
+		ops = append(ops, key)
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		if ops[i].op != ops[j].op {
+			return ops[i].op < ops[j].op
+		}
+		return !ops[i].failed && ops[j].failed
+	})
+	for _, key := range ops {
+		m.ops[key].write(w, "db_operation_duration_seconds", fmt.Sprintf("op=%q,failed=\"%t\",", key.op, key.failed))
+	}
+
+	fmt.Fprintln(w, "# HELP db_segments Number of segment files.")
+	fmt.Fprintln(w, "# TYPE db_segments gauge")
+	fmt.Fprintf(w, "db_segments %d\n", stats.Segments)
+	fmt.Fprintln(w, "# HELP db_size_bytes Total size of the segment files.")
+	fmt.Fprintln(w, "# TYPE db_size_bytes gauge")
+	fmt.Fprintf(w, "db_size_bytes %d\n", stats.Size)
+	fmt.Fprintln(w, "# HELP db_keys Number of live keys.")
+	fmt.Fprintln(w, "# TYPE db_keys gauge")
+	fmt.Fprintf(w, "db_keys %d\n", stats.Keys)
+}
+
+func handleMetrics(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(rw, http.MethodGet)
+		return
+	}
+	stats, err := db.Stats()
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	rw.Header().Set("content-type", "text/plain; version=0.0.4")
+	serviceMetrics.write(rw, stats)
+}
+
+// handleStats answers with the datastore.Stats of the database as JSON.
+func handleStats(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(rw, http.MethodGet)
+		return
+	}
+	stats, err := db.Stats()
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	rw.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(rw).Encode(stats)
+}
+
+// observeOp reports datastore operations to the metrics and logs the slow ones.
+func observeOp(op datastore.Op, d time.Duration, err error) {
+	serviceMetrics.observeOp(op, d, err)
+	if cfg.SlowOp > 0 && d > time.Duration(cfg.SlowOp) {
+		log.Printf("Slow %s operation: %s (error: %v)", op, d, err)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+func TestMetrics(t *testing.T) {
+	m := newMetrics()
+	newDb, err := datastore.NewDb("db", datastore.WithFS(datastore.NewMemFS()), datastore.WithObserver(m.observeOp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newDb.Close()
+	db = newDb
+
+	h := http.NewServeMux()
+	h.HandleFunc("/db/", handleDb)
+	server := m.instrument(h)
+	for _, r := range []*http.Request{
+		httptest.NewRequest("PUT", "/db/k", strings.NewReader(`{"type":"string","value":"v"}`)),
+		httptest.NewRequest("GET", "/db/k", nil),
+		httptest.NewRequest("GET", "/db/missing", nil),
+		httptest.NewRequest("PATCH", "/db/k", nil),
+	} {
+		server.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	m.observeRequest("GET", http.StatusOK, 20*time.Second)
+
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	m.write(&out, stats)
+	for _, line := range []string{
+		`db_http_requests_total{method="PUT",status="204"} 1`,
+		`db_http_requests_total{method="GET",status="200"} 2`,
+		`db_http_requests_total{method="GET",status="404"} 1`,
+		`db_http_requests_total{method="other",status="405"} 1`,
+		`db_http_request_duration_seconds_bucket{method="GET",status="200",le="10"} 1`,
+		`db_http_request_duration_seconds_bucket{method="GET",status="200",le="+Inf"} 2`,
+		`db_http_request_duration_seconds_count{method="GET",status="200"} 2`,
+		`db_operation_duration_seconds_count{op="put",failed="false"} 1`,
+		`db_operation_duration_seconds_count{op="queue",failed="false"} 1`,
+		`db_segments 1`,
+		`db_keys 1`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("Expected %s in\n%s", line, out.String())
+		}
+	}
+
+	rw := httptest.NewRecorder()
+	handleStats(rw, httptest.NewRequest("GET", "/stats", nil))
+	if expected := fmt.Sprintf(`{"segments":1,"size":%d,"keys":1}`, stats.Size); strings.TrimSpace(rw.Body.String()) != expected {
+		t.Errorf("Expected %s, got %d: %s", expected, rw.Code, rw.Body)
+	}
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+// The listener started with -resp-port speaks a subset of the Redis protocol (RESP),
+// so Redis clients and redis-benchmark can be used with the database:
+// https://redis.io/docs/reference/protocol-spec/
+
+// Commands are arrays of bulk strings, the number of their elements is limited
+const maxRespArgs = 1024
+
+// The room for arguments besides a key and a value in the size limit of a command, see maxRespCommandSize
+const respOptionsSize = 1024
+
+// maxRespCommandSize limits the total size of the bulk strings of a command,
+// so a command can't buffer much more than the largest key and value.
+func maxRespCommandSize() int64 {
+	return cfg.MaxKeySize + cfg.MaxValueSize + respOptionsSize
+}
+
+// Keys returned by a single SCAN call unless COUNT says otherwise
+const defaultScanCount = 10
+
+// The number of arguments of supported commands including the name. A negative one is the minimal number
+var respArity = map[string]int{
+	"PING": -1, "QUIT": 1, "AUTH": -2, "GET": 2, "SET": -3, "DEL": -2, "EXISTS": -2, "INCRBY": 3, "SCAN": -2,
+}
+
+// The permissions needed by commands for their keys: the first argument, or all of them for DEL and EXISTS
+var respPermissions = map[string]permission{
+	"GET": permRead, "EXISTS": permRead, "SET": permWrite, "DEL": permWrite, "INCRBY": permWrite,
+}
+
+type respConn struct {
+	r *bufio.Reader
+	w *bufio.Writer
+	// The token given with AUTH
+	token *token
+	addr  string
+}
+
+func handleRESPConn(conn net.Conn) {
+	defer conn.Close()
+	c := &respConn{r: bufio.NewReader(conn), w: bufio.NewWriter(conn), addr: conn.RemoteAddr().String()}
+	for {
+		args, err := c.readCommand()
+		if err != nil {
+			// A read deadline is set when the connection is drained on shutdown
+			if err != io.EOF && !errors.Is(err, os.ErrDeadlineExceeded) {
+				c.writeError("ERR Protocol error: " + err.Error())
+				c.w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := c.exec(args)
+		// Replies to pipelined commands are sent together
+		if c.r.Buffered() == 0 || quit {
+			if err := c.w.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// readCommand reads either an array of bulk strings or an inline command separated by spaces.
+func (c *respConn) readCommand() ([]string, error) {
+	line, err := readLine(c.r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > maxRespArgs {
+		return nil, fmt.Errorf("invalid multibulk length")
+	}
+	args := make([]string, 0, n)
+	var total int64
+	for i := 0; i < n; i++ {
+		line, err := readLine(c.r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("expected '$', got %q", line)
+		}
+		size, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil || size < 0 || size > cfg.MaxValueSize {
+			return nil, fmt.Errorf("invalid bulk length")
+		}
+		if total += size; total > maxRespCommandSize() {
+			return nil, fmt.Errorf("command is larger than %d bytes", maxRespCommandSize())
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		if string(data[size:]) != "\r\n" {
+			return nil, fmt.Errorf("bulk string is not terminated by CRLF")
+		}
+		args = append(args, string(data[:size]))
+	}
+	return args, nil
+}
+
+var errLineTooLong = errors.New("too big inline request")
+
+// readLine reads a line terminated by LF or CRLF, which has to fit the buffer of r.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", errLineTooLong
+	}
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+}
+
+// exec runs the command and writes its reply. It returns true if the connection has to be closed.
+func (c *respConn) exec(args []string) bool {
+	name := strings.ToUpper(args[0])
+	n, ok := respArity[name]
+	if !ok {
+		c.writeError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return false
+	}
+	if (n > 0 && len(args) != n) || (n < 0 && len(args) < -n) {
+		c.writeError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return false
+	}
+
+	if !c.authorize(name, args) {
+		return false
+	}
+
+	switch name {
+	case "AUTH":
+		c.auth(args[1:])
+	case "PING":
+		if len(args) > 1 {
+			c.writeBulk(args[1])
+		} else {
+			c.writeSimple("PONG")
+		}
+	case "QUIT":
+		c.writeSimple("OK")
+		return true
+	case "GET":
+		value, _, err := db.Lookup(args[1])
+		if errors.Is(err, datastore.ErrNotFound) {
+			c.writeNil()
+		} else if err != nil {
+			c.writeDbError(err)
+		} else {
+			c.writeBulk(value)
+		}
+	case "SET":
+		if len(args) > 3 {
+			c.writeError("ERR syntax error")
+		} else if err := db.Put(args[1], args[2]); err != nil {
+			c.writeDbError(err)
+		} else {
+			c.audit("put", args[1], args[2])
+			c.writeSimple("OK")
+		}
+	case "DEL":
+		deleted := 0
+		for _, key := range args[1:] {
+			err := db.Delete(key)
+			if err == nil {
+				c.audit("delete", key, "")
+				deleted++
+			} else if !errors.Is(err, datastore.ErrNotFound) {
+				c.writeDbError(err)
+				return false
+			}
+		}
+		c.writeInt(int64(deleted))
+	case "EXISTS":
+		found := 0
+		for _, key := range args[1:] {
+			exists, err := db.Exists(key)
+			if err != nil {
+				c.writeDbError(err)
+				return false
+			}
+			if exists {
+				found++
+			}
+		}
+		c.writeInt(int64(found))
+	case "INCRBY":
+		delta, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			c.writeError("ERR value is not an integer or out of range")
+			return false
+		}
+		result, err := respIncrBy(args[1], delta)
+		if errors.Is(err, errNotInteger) {
+			c.writeError("ERR value is not an integer or out of range")
+		} else if err != nil {
+			c.writeDbError(err)
+		} else {
+			c.audit("incr", args[1], strconv.FormatInt(result, 10))
+			c.writeInt(result)
+		}
+	case "SCAN":
+		c.scan(args[1:])
+	}
+	return false
+}
+
+var errNotInteger = errors.New("value is not an integer")
+
+// respIncrBy adds delta to the value of the key like INCRBY of Redis: int64 values and missing keys
+// are incremented by the datastore, strings of decimal integers stay strings, as SET stores them.
+func respIncrBy(key string, delta int64) (int64, error) {
+	for {
+		result, err := db.IncrBy(key, delta)
+		if !errors.Is(err, datastore.ErrWrongType) {
+			return result, err
+		}
+		v, err := db.Latest(key)
+		if errors.Is(err, datastore.ErrNotFound) {
+			// Deleted since, the datastore can increment it now
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if v.Type != "string" {
+			// Replaced by an int64 value since
+			continue
+		}
+		n, err := strconv.ParseInt(v.Value, 10, 64)
+		if err != nil {
+			return 0, errNotInteger
+		}
+		if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+			return 0, datastore.ErrOverflow
+		}
+		n += delta
+		_, err = db.PutIf(key, strconv.FormatInt(n, 10), datastore.Condition{Seq: v.Seq})
+		if errors.Is(err, datastore.ErrConditionFailed) {
+			// Changed by another client since it was read
+			continue
+		}
+		return n, err
+	}
+}
+
+// authorize checks that the command is allowed to the connection when authentication is enabled.
+// Otherwise it replies with an error, recording a denied permission in the audit log.
+func (c *respConn) authorize(name string, args []string) bool {
+	if tokens == nil || name == "AUTH" || name == "QUIT" {
+		return true
+	}
+	if c.token == nil {
+		c.writeError("NOAUTH Authentication required.")
+		return false
+	}
+	perm, ok := respPermissions[name]
+	if !ok {
+		return true
+	}
+	keys := args[1:2]
+	if name == "DEL" || name == "EXISTS" {
+		keys = args[1:]
+	}
+	for _, key := range keys {
+		if !c.token.allows(perm, key) {
+			denialLog.Printf("Denied RESP %s from %s: token %s can't %s %q", name, c.addr, c.token.Name, perm, key)
+			c.writeError(fmt.Sprintf("NOPERM this token can't %s %q", perm, key))
+			return false
+		}
+	}
+	return true
+}
+
+// audit records a change made by the connection.
+func (c *respConn) audit(op, key, value string) {
+	name := "anonymous"
+	if c.token != nil {
+		name = c.token.Name
+	}
+	audit(newAuditRecord("resp", c.addr, name, op, key, value))
+}
+
+// auth replies to AUTH [username] token. The username, if given, has to be the name of the token.
+func (c *respConn) auth(args []string) {
+	if len(args) > 2 {
+		c.writeError("ERR syntax error")
+		return
+	}
+	if tokens == nil {
+		c.writeError("ERR AUTH called without any tokens configured")
+		return
+	}
+	t := findToken(args[len(args)-1])
+	if t == nil || (len(args) == 2 && args[0] != t.Name) {
+		denialLog.Printf("Denied RESP AUTH from %s: no valid token", c.addr)
+		c.writeError("WRONGPASS invalid username-password pair or user is disabled.")
+		return
+	}
+	c.token = t
+	c.writeSimple("OK")
+}
+
+// scan replies to SCAN cursor [MATCH pattern] [COUNT count].
+// The cursor is a position in the sorted list of keys, so keys added or removed
+// between the calls may shift the following keys and make them returned twice or missed.
+func (c *respConn) scan(args []string) {
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		c.writeError("ERR invalid cursor")
+		return
+	}
+	pattern, count := "*", defaultScanCount
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			c.writeError("ERR syntax error")
+			return
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil || count < 1 {
+				c.writeError("ERR value is not an integer or out of range")
+				return
+			}
+		default:
+			c.writeError("ERR syntax error")
+			return
+		}
+	}
+
+	keys := db.Keys()
+	start := uint64(len(keys))
+	if cursor < start {
+		start = cursor
+	}
+	end := start + uint64(count)
+	next := end
+	if end >= uint64(len(keys)) {
+		end, next = uint64(len(keys)), 0
+	}
+	var matched []string
+	for _, key := range keys[start:end] {
+		// Keys the token can't read are skipped like unmatched ones
+		if globMatch(pattern, key) && !isMemcachedMeta(key) && (tokens == nil || c.token.allows(permRead, key)) {
+			matched = append(matched, key)
+		}
+	}
+
+	c.writeArray(2)
+	c.writeBulk(strconv.FormatUint(next, 10))
+	c.writeArray(len(matched))
+	for _, key := range matched {
+		c.writeBulk(key)
+	}
+}
+
+// globMatch reports whether s matches the Redis glob pattern with *, ?, [...] and \ escapes.
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		case '[':
+			end := strings.IndexByte(pattern[1:], ']') + 1
+			if end == 0 || len(s) == 0 {
+				return false
+			}
+			if !classMatch(pattern[1:end], s[0]) {
+				return false
+			}
+			pattern, s = pattern[end+1:], s[1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		}
+	}
+	return len(s) == 0
+}
+
+// classMatch matches a byte against the inside of [...], such as "a-z0" or "^x".
+func classMatch(class string, b byte) bool {
+	negate := strings.HasPrefix(class, "^")
+	if negate {
+		class = class[1:]
+	}
+	for i := 0; i < len(class); i++ {
+		if i+2 < len(class) && class[i+1] == '-' {
+			if class[i] <= b && b <= class[i+2] {
+				return !negate
+			}
+			i += 2
+		} else if class[i] == b {
+			return !negate
+		}
+	}
+	return negate
+}
+
+func (c *respConn) writeSimple(s string) {
+	c.w.WriteString("+" + s + "\r\n")
+}
+
+func (c *respConn) writeError(s string) {
+	c.w.WriteString("-" + s + "\r\n")
+}
+
+func (c *respConn) writeDbError(err error) {
+	if errors.Is(err, datastore.ErrWrongType) {
+		c.writeError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return
+	}
+	// Error replies are single lines
+	c.writeError("ERR " + strings.ReplaceAll(err.Error(), "\n", " "))
+}
+
+func (c *respConn) writeInt(n int64) {
+	c.w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (c *respConn) writeBulk(s string) {
+	c.w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n")
+	c.w.WriteString(s)
+	c.w.WriteString("\r\n")
+}
+
+func (c *respConn) writeNil() {
+	c.w.WriteString("$-1\r\n")
+}
+
+func (c *respConn) writeArray(n int) {
+	c.w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+func TestRESP(t *testing.T) {
+	newDb, err := datastore.NewDb("db", datastore.WithFS(datastore.NewMemFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newDb.Close()
+	db = newDb
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go handleRESPConn(server)
+
+	// Commands are pipelined, and the last two are inline
+	requests := "*3\r\n$3\r\nSET\r\n$4\r\nkey1\r\n$5\r\nvalue\r\n" +
+		"*2\r\n$3\r\nGET\r\n$4\r\nkey1\r\n" +
+		"*2\r\n$3\r\nGET\r\n$7\r\nmissing\r\n" +
+		"*3\r\n$6\r\nINCRBY\r\n$7\r\ncounter\r\n$2\r\n-5\r\n" +
+		"*3\r\n$6\r\nINCRBY\r\n$4\r\nkey1\r\n$1\r\n1\r\n" +
+		"*3\r\n$3\r\nSET\r\n$3\r\nnum\r\n$2\r\n10\r\n" +
+		"*3\r\n$6\r\nINCRBY\r\n$3\r\nnum\r\n$1\r\n1\r\n" +
+		"*2\r\n$3\r\nGET\r\n$3\r\nnum\r\n" +
+		"*4\r\n$6\r\nEXISTS\r\n$4\r\nkey1\r\n$7\r\ncounter\r\n$7\r\nmissing\r\n" +
+		"*4\r\n$4\r\nSCAN\r\n$1\r\n0\r\n$5\r\nMATCH\r\n$4\r\nkey*\r\n" +
+		"*3\r\n$3\r\nDEL\r\n$4\r\nkey1\r\n$7\r\nmissing\r\n" +
+		"*1\r\n$4\r\nHSET\r\n" +
+		"GET counter\r\n" +
+		"PING\r\n"
+	expected := "+OK\r\n" +
+		"$5\r\nvalue\r\n" +
+		"$-1\r\n" +
+		":-5\r\n" +
+		"-ERR value is not an integer or out of range\r\n" +
+		"+OK\r\n" +
+		":11\r\n" +
+		"$2\r\n11\r\n" +
+		":2\r\n" +
+		"*2\r\n$1\r\n0\r\n*1\r\n$4\r\nkey1\r\n" +
+		":1\r\n" +
+		"-ERR unknown command 'HSET'\r\n" +
+		"$2\r\n-5\r\n" +
+		"+PONG\r\n"
+
+	go func() {
+		io.WriteString(client, requests)
+	}()
+	reply := make([]byte, len(expected))
+	if _, err := io.ReadFull(bufio.NewReader(client), reply); err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != expected {
+		t.Errorf("Unexpected replies:\n%s\nexpected:\n%s", reply, expected)
+	}
+}
+
+func TestRESPCommandSize(t *testing.T) {
+	defer func(keySize, valueSize int64) {
+		cfg.MaxKeySize, cfg.MaxValueSize = keySize, valueSize
+	}(cfg.MaxKeySize, cfg.MaxValueSize)
+	cfg.MaxKeySize, cfg.MaxValueSize = 8, 16
+
+	// Every argument fits the value limit, but all of them together don't fit the command one
+	command := "*200\r\n$3\r\nDEL\r\n" + strings.Repeat("$8\r\nkey:0000\r\n", 199)
+	c := &respConn{r: bufio.NewReader(strings.NewReader(command))}
+	if _, err := c.readCommand(); err == nil || !strings.Contains(err.Error(), "command is larger") {
+		t.Errorf("Expected the command to be rejected, got %v", err)
+	}
+	command = "*3\r\n$3\r\nSET\r\n$8\r\nkey:0000\r\n$16\r\n" + strings.Repeat("v", 16) + "\r\n"
+	c = &respConn{r: bufio.NewReader(strings.NewReader(command))}
+	if args, err := c.readCommand(); err != nil || len(args) != 3 {
+		t.Errorf("Unexpected command %q: %v", args, err)
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "users", false},
+		{"h?llo", "hello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{`a\*`, "a*", true},
+		{`a\*`, "ab", false},
+	} {
+		if globMatch(c.pattern, c.s) != c.match {
+			t.Errorf("globMatch(%q, %q) != %t", c.pattern, c.s, c.match)
+		}
+	}
+}
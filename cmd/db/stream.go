@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Values sent and received with this content type are streamed as raw bytes instead of JSON
+const streamContentType = "application/octet-stream"
+
+func wantsStream(r *http.Request) bool {
+	t := r.URL.Query().Get("type")
+	return (t == "" || t == "string") && strings.Contains(r.Header.Get("accept"), streamContentType)
+}
+
+// The bytes of a streamed value between extensions of the deadlines of the connection,
+// which are too short for large values. Each chunk has bulkChunkTimeout to be transferred.
+const streamChunk = 1 << 20
+
+// countingWriter remembers whether anything has been written to the response yet.
+type countingWriter struct {
+	rw       http.ResponseWriter
+	rc       *http.ResponseController
+	n        int64
+	extendAt int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.n >= w.extendAt {
+		_ = w.rc.SetWriteDeadline(time.Now().Add(bulkChunkTimeout))
+		w.extendAt = w.n + streamChunk
+	}
+	n, err := w.rw.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// deadlineReader extends the deadlines of the connection as a value is read from the request.
+type deadlineReader struct {
+	r        io.Reader
+	rc       *http.ResponseController
+	n        int64
+	extendAt int64
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	if r.n >= r.extendAt {
+		// The write deadline counts from the start of the request too, it has to last until the response
+		deadline := time.Now().Add(bulkChunkTimeout)
+		_ = r.rc.SetReadDeadline(deadline)
+		_ = r.rc.SetWriteDeadline(deadline)
+		r.extendAt = r.n + streamChunk
+	}
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func handleDbGetStream(rw http.ResponseWriter, key string) {
+	rw.Header().Set("content-type", streamContentType)
+	out := &countingWriter{rw: rw, rc: http.NewResponseController(rw)}
+	err := db.GetStream(key, out)
+	if err == nil {
+		return
+	}
+	if out.n == 0 {
+		writeError(rw, err)
+	} else {
+		// The status is already sent, so the client can only notice the broken body
+		log.Printf("Failed to stream value of %s: %s", key, err)
+	}
+}
+
+func handleDbPostStream(rw http.ResponseWriter, r *http.Request, key string) {
+	if conditional(r) {
+		writeErrorStatus(rw, http.StatusNotImplemented, "not_implemented", "Streamed values can't be written conditionally")
+		return
+	}
+	if r.ContentLength < 0 {
+		writeErrorStatus(rw, http.StatusLengthRequired, "length_required", "Content-Length is required")
+		return
+	}
+	// The value is hashed as it streams through
+	hash := sha256.New()
+	body := &deadlineReader{r: r.Body, rc: http.NewResponseController(rw)}
+	err := db.PutStream(key, io.TeeReader(body, hash), r.ContentLength)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	if mutationLog != nil {
+		rec := newAuditRecord("http", r.RemoteAddr, identity(r), "put", key, "")
+		rec.ValueSHA256 = hex.EncodeToString(hash.Sum(nil))
+		audit(rec)
+	}
+}
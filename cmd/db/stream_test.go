@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+func TestStreamOutlastsTimeouts(t *testing.T) {
+	newDb, err := datastore.NewDb("db", datastore.WithFS(datastore.NewMemFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newDb.Close()
+	db = newDb
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(handleDb))
+	server.Config.ReadTimeout = 100 * time.Millisecond
+	server.Config.WriteTimeout = 100 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	// Larger than the buffers of the connection, so the writes of the server wait for the client
+	value := strings.Repeat("0123456789abcdef", 1<<19)
+	body, w := io.Pipe()
+	go func() {
+		io.WriteString(w, value[:len(value)/2])
+		time.Sleep(300 * time.Millisecond)
+		io.WriteString(w, value[len(value)/2:])
+		w.Close()
+	}()
+	req, err := http.NewRequest("PUT", server.URL+"/db/big", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("content-type", streamContentType)
+	req.ContentLength = int64(len(value))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status of the slow upload %d", resp.StatusCode)
+	}
+
+	req, err = http.NewRequest("GET", server.URL+"/db/big", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("accept", streamContentType)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	first := make([]byte, 1<<10)
+	if _, err := io.ReadFull(resp.Body, first); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil || !bytes.Equal(append(first, rest...), []byte(value)) {
+		t.Errorf("The slow download is cut after %d bytes: %v", len(first)+len(rest), err)
+	}
+}
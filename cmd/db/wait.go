@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+// GET /db/{key}?wait=30s&after=<version> is a long poll: it answers once the key has a version
+// newer than after, an ETag of an earlier response, or with 304 Not Modified when the wait is over.
+// Without after it answers at once if the key exists, and otherwise waits for it to be written.
+
+// The longest wait of a long poll
+const maxWait = 5 * time.Minute
+
+var errInvalidWait = fmt.Errorf("%w: wait has to be a duration up to %s, and after a version", errConvertType, maxWait)
+
+// Closed on shutdown to end the long polls, which would otherwise hold up draining the server
+var stopWaits = make(chan struct{})
+
+// errNotChanged is returned by waitLatest when the key doesn't change during the wait.
+var errNotChanged = errors.New("not changed")
+
+// waitLatest waits for the version of the key following the one given with ?after=.
+func waitLatest(rw http.ResponseWriter, r *http.Request, key string) (datastore.Version, uint64, error) {
+	query := r.URL.Query()
+	wait, err := time.ParseDuration(query.Get("wait"))
+	if err != nil || wait < 0 || wait > maxWait {
+		return datastore.Version{}, 0, errInvalidWait
+	}
+	var after uint64
+	if tag := query.Get("after"); tag != "" {
+		if !strings.HasPrefix(tag, `"`) {
+			tag = `"` + tag + `"`
+		}
+		var ok bool
+		if after, _, ok = parseETag(tag); !ok {
+			return datastore.Version{}, 0, errInvalidWait
+		}
+	}
+	// The server limits the time to write a response, which has to include the wait
+	_ = http.NewResponseController(rw).SetWriteDeadline(time.Now().Add(wait + 10*time.Second))
+
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+	go func() {
+		select {
+		case <-stopWaits:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	v, err := db.Wait(ctx, key, after)
+	if err != nil && ctx.Err() != nil && r.Context().Err() == nil {
+		err = errNotChanged
+	}
+	return v, after, err
+}
+
+// writeNotChanged answers a long poll during which the key didn't change.
+func writeNotChanged(rw http.ResponseWriter, after uint64) {
+	if after != 0 {
+		rw.Header().Set("etag", etag(after))
+	}
+	rw.WriteHeader(http.StatusNotModified)
+}
+
+// isLongPoll tells whether the request is a long poll, which isn't limited by the operation timeout.
+func isLongPoll(r *http.Request) bool {
+	return r.Method == http.MethodGet && r.URL.Query().Has("wait")
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+func TestHandleDbLongPoll(t *testing.T) {
+	newDb, err := datastore.NewDb("db", datastore.WithFS(datastore.NewMemFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newDb.Close()
+	db = newDb
+	seq, err := db.PutIf("config", "v1", datastore.Condition{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	poll := func(query string) <-chan *httptest.ResponseRecorder {
+		done := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			rw := httptest.NewRecorder()
+			handleDb(rw, httptest.NewRequest("GET", "/db/config?"+query, nil))
+			done <- rw
+		}()
+		return done
+	}
+
+	done := poll("wait=1s&after=" + etag(seq))
+	time.Sleep(20 * time.Millisecond)
+	newSeq, err := db.PutIf("config", "v2", datastore.Condition{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw := <-done
+	var body struct{ Value string }
+	if err := json.Unmarshal(rw.Body.Bytes(), &body); err != nil || rw.Code != http.StatusOK {
+		t.Fatalf("Unexpected response %d: %s", rw.Code, rw.Body)
+	}
+	if body.Value != "v2" || rw.Header().Get("etag") != etag(newSeq) {
+		t.Errorf("Expected v2 with the ETag %s, got %s with %s", etag(newSeq), body.Value, rw.Header().Get("etag"))
+	}
+
+	// Bare sequence numbers are accepted as well
+	if rw := <-poll("wait=20ms&after=" + strconv.FormatUint(newSeq, 10)); rw.Code != http.StatusNotModified || rw.Header().Get("etag") != etag(newSeq) {
+		t.Errorf("Expected 304 after the wait, got %d", rw.Code)
+	}
+	if rw := <-poll("wait=20ms"); rw.Code != http.StatusOK {
+		t.Errorf("Expected the current value without after, got %d", rw.Code)
+	}
+	for _, query := range []string{"wait=forever", "wait=1h", "wait=1s&after=x"} {
+		if rw := <-poll(query); rw.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: expected 422, got %d", query, rw.Code)
+		}
+	}
+}
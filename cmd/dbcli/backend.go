@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+	"github.com/roman-mazur/design-practice-2-template/dbclient"
+)
+
+// entry is a value with its key and type, "string" or "int64".
+type entry struct {
+	Key   string `json:"key"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// backend is the database the commands are run against: the db service or a local directory.
+type backend interface {
+	Get(ctx context.Context, key string) (entry, error)
+	Put(ctx context.Context, e entry) error
+	Delete(ctx context.Context, key string) error
+	IncrBy(ctx context.Context, key string, delta int64) (int64, error)
+	// Scan returns up to limit keys starting with prefix in ascending order.
+	Scan(ctx context.Context, prefix string, limit int) ([]string, error)
+	Stats(ctx context.Context) (datastore.Stats, error)
+	Close() error
+}
+
+// Both backends report missing keys and overflows of increments with them
+var (
+	errNotFound = errors.New("not found")
+	errOverflow = errors.New("increment or decrement would overflow int64")
+)
+
+// httpBackend uses the HTTP API of the db service.
+type httpBackend struct {
+	c *dbclient.Client
+}
+
+func (b httpBackend) Get(ctx context.Context, key string) (entry, error) {
+	entries, err := b.c.MGet(ctx, key)
+	if err != nil {
+		return entry{}, err
+	}
+	e, ok := entries[key]
+	if !ok {
+		return entry{}, errNotFound
+	}
+	return entry{key, e.Type, e.Value}, nil
+}
+
+func (b httpBackend) Put(ctx context.Context, e entry) error {
+	if e.Type == "int64" {
+		n, err := strconv.ParseInt(e.Value, 10, 64)
+		if err != nil {
+			return err
+		}
+		return b.c.PutInt64(ctx, e.Key, n)
+	}
+	return b.c.Put(ctx, e.Key, e.Value)
+}
+
+func (b httpBackend) Delete(ctx context.Context, key string) error {
+	err := b.c.Delete(ctx, key)
+	if errors.Is(err, dbclient.ErrNotFound) {
+		return errNotFound
+	}
+	return err
+}
+
+func (b httpBackend) IncrBy(ctx context.Context, key string, delta int64) (int64, error) {
+	n, err := b.c.IncrBy(ctx, key, delta)
+	if errors.Is(err, dbclient.ErrOverflow) {
+		return 0, errOverflow
+	}
+	return n, err
+}
+
+func (b httpBackend) Scan(ctx context.Context, prefix string, limit int) ([]string, error) {
+	keys, _, err := b.c.ScanPage(ctx, prefix, "", limit)
+	return keys, err
+}
+
+func (b httpBackend) Stats(ctx context.Context) (datastore.Stats, error) {
+	stats, err := b.c.Stats(ctx)
+	return datastore.Stats(stats), err
+}
+
+func (b httpBackend) Close() error {
+	return nil
+}
+
+// localBackend opens the directory of a database directly.
+type localBackend struct {
+	db *datastore.Db
+}
+
+func (b localBackend) Get(ctx context.Context, key string) (entry, error) {
+	value, vType, err := b.db.LookupContext(ctx, key)
+	if errors.Is(err, datastore.ErrNotFound) {
+		return entry{}, errNotFound
+	}
+	return entry{key, vType, value}, err
+}
+
+func (b localBackend) Put(ctx context.Context, e entry) error {
+	if e.Type == "int64" {
+		n, err := strconv.ParseInt(e.Value, 10, 64)
+		if err != nil {
+			return err
+		}
+		return b.db.PutInt64Context(ctx, e.Key, n)
+	}
+	return b.db.PutContext(ctx, e.Key, e.Value)
+}
+
+func (b localBackend) Delete(ctx context.Context, key string) error {
+	err := b.db.DeleteContext(ctx, key)
+	if errors.Is(err, datastore.ErrNotFound) {
+		return errNotFound
+	}
+	return err
+}
+
+func (b localBackend) IncrBy(ctx context.Context, key string, delta int64) (int64, error) {
+	n, err := b.db.IncrByContext(ctx, key, delta)
+	if errors.Is(err, datastore.ErrOverflow) {
+		return 0, errOverflow
+	}
+	return n, err
+}
+
+func (b localBackend) Scan(_ context.Context, prefix string, limit int) ([]string, error) {
+	keys := b.db.Keys()
+	start := sort.SearchStrings(keys, prefix)
+	var found []string
+	for _, key := range keys[start:] {
+		if !strings.HasPrefix(key, prefix) || len(found) == limit {
+			break
+		}
+		found = append(found, key)
+	}
+	return found, nil
+}
+
+func (b localBackend) Stats(context.Context) (datastore.Stats, error) {
+	return b.db.Stats()
+}
+
+func (b localBackend) Close() error {
+	return b.db.Close()
+}
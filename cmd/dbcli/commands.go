@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const commandsHelp = `Commands:
+  get <key>                    print the value of the key and its type
+  put <key> <value> [type]     put a value of the type string (the default) or int64
+  del <key>...                 delete the keys
+  incr <key> [delta]           add delta (1 by default) to an int64 value, a missing key counts as 0
+  scan [prefix] [limit]        list up to limit (100 by default) keys starting with the prefix
+  stats                        print the number of segments, their size and the number of keys
+  output [table|json]          print or set the output format
+  help                         print this help
+  quit                         exit, as does Ctrl-D
+
+Words containing spaces can be quoted with "" or ''.
+`
+
+var commands = []string{"get", "put", "del", "incr", "scan", "stats", "output", "help", "quit", "exit"}
+
+var formats = []string{"table", "json"}
+
+// The number of keys listed by scan without a limit, and completed by tab
+const (
+	defaultScanLimit = 100
+	completionLimit  = 50
+)
+
+var errUsage = errors.New("usage")
+
+// errQuit is returned by exec for quit.
+var errQuit = errors.New("quit")
+
+// cli runs commands against the backend and prints their results.
+type cli struct {
+	b       backend
+	out     io.Writer
+	format  string
+	timeout time.Duration
+}
+
+// runLine runs the command of a line of input, if there is one.
+func (c *cli) runLine(line string) error {
+	args, err := splitArgs(line)
+	if err != nil || len(args) == 0 {
+		return err
+	}
+	return c.run(args)
+}
+
+// run runs the command with the arguments. It returns errQuit for quit.
+func (c *cli) run(args []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	err := c.exec(ctx, args)
+	if errors.Is(err, errUsage) {
+		return fmt.Errorf("%w, see help", err)
+	}
+	return err
+}
+
+func (c *cli) exec(ctx context.Context, args []string) error {
+	switch cmd, args := args[0], args[1:]; cmd {
+	case "get":
+		if len(args) != 1 {
+			return fmt.Errorf("%w: get <key>", errUsage)
+		}
+		e, err := c.b.Get(ctx, args[0])
+		if err != nil {
+			return keyError(err, args[0])
+		}
+		return c.print(e, func(w io.Writer) {
+			fmt.Fprintln(w, "KEY\tTYPE\tVALUE")
+			fmt.Fprintf(w, "%s\t%s\t%s\n", e.Key, e.Type, e.Value)
+		})
+	case "put":
+		if len(args) != 2 && len(args) != 3 {
+			return fmt.Errorf("%w: put <key> <value> [string|int64]", errUsage)
+		}
+		e := entry{Key: args[0], Type: "string", Value: args[1]}
+		if len(args) == 3 {
+			e.Type = args[2]
+		}
+		if e.Type != "string" && e.Type != "int64" {
+			return fmt.Errorf("unknown type %q, it can be string or int64", e.Type)
+		}
+		if err := c.b.Put(ctx, e); err != nil {
+			return err
+		}
+		return c.print(e, func(w io.Writer) {
+			fmt.Fprintln(w, "OK")
+		})
+	case "del":
+		if len(args) == 0 {
+			return fmt.Errorf("%w: del <key>...", errUsage)
+		}
+		deleted := make([]string, 0, len(args))
+		for _, key := range args {
+			err := c.b.Delete(ctx, key)
+			if errors.Is(err, errNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			deleted = append(deleted, key)
+		}
+		return c.print(struct {
+			Deleted []string `json:"deleted"`
+		}{deleted}, func(w io.Writer) {
+			fmt.Fprintf(w, "Deleted %d of %d keys\n", len(deleted), len(args))
+		})
+	case "incr":
+		if len(args) != 1 && len(args) != 2 {
+			return fmt.Errorf("%w: incr <key> [delta]", errUsage)
+		}
+		delta := int64(1)
+		if len(args) == 2 {
+			var err error
+			if delta, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+				return fmt.Errorf("delta has to be an int64: %w", err)
+			}
+		}
+		n, err := c.b.IncrBy(ctx, args[0], delta)
+		if err != nil {
+			return err
+		}
+		return c.print(entry{args[0], "int64", strconv.FormatInt(n, 10)}, func(w io.Writer) {
+			fmt.Fprintln(w, n)
+		})
+	case "scan":
+		if len(args) > 2 {
+			return fmt.Errorf("%w: scan [prefix] [limit]", errUsage)
+		}
+		prefix, limit := "", defaultScanLimit
+		if len(args) > 0 {
+			prefix = args[0]
+		}
+		if len(args) == 2 {
+			var err error
+			if limit, err = strconv.Atoi(args[1]); err != nil || limit < 1 {
+				return errors.New("limit has to be a positive number")
+			}
+		}
+		keys, err := c.b.Scan(ctx, prefix, limit)
+		if err != nil {
+			return err
+		}
+		if keys == nil {
+			keys = make([]string, 0)
+		}
+		return c.print(struct {
+			Keys []string `json:"keys"`
+		}{keys}, func(w io.Writer) {
+			fmt.Fprintln(w, "KEY")
+			for _, key := range keys {
+				fmt.Fprintln(w, key)
+			}
+		})
+	case "stats":
+		stats, err := c.b.Stats(ctx)
+		if err != nil {
+			return err
+		}
+		return c.print(stats, func(w io.Writer) {
+			fmt.Fprintln(w, "SEGMENTS\tSIZE\tKEYS")
+			fmt.Fprintf(w, "%d\t%d\t%d\n", stats.Segments, stats.Size, stats.Keys)
+		})
+	case "output":
+		if len(args) == 0 {
+			fmt.Fprintln(c.out, c.format)
+			return nil
+		}
+		if len(args) != 1 || (args[0] != "table" && args[0] != "json") {
+			return fmt.Errorf("%w: output [table|json]", errUsage)
+		}
+		c.format = args[0]
+		return nil
+	case "help":
+		fmt.Fprint(c.out, commandsHelp)
+		return nil
+	case "quit", "exit":
+		return errQuit
+	default:
+		return fmt.Errorf("unknown command %q, see help", cmd)
+	}
+}
+
+// print prints v as JSON or calls table to print it as a table.
+func (c *cli) print(v interface{}, table func(w io.Writer)) error {
+	if c.format == "json" {
+		return json.NewEncoder(c.out).Encode(v)
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	table(w)
+	return w.Flush()
+}
+
+func keyError(err error, key string) error {
+	if errors.Is(err, errNotFound) {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	return err
+}
+
+// complete returns the candidates for the last word of the line: commands, keys, types or formats.
+func (c *cli) complete(line string) []string {
+	words := strings.Fields(line)
+	if len(words) > 0 && !strings.HasSuffix(line, " ") {
+		// The last word is being typed
+		words = words[:len(words)-1]
+	}
+	word := line[strings.LastIndexAny(line, " \t")+1:]
+	var candidates []string
+	switch {
+	case len(words) == 0:
+		candidates = commands
+	case words[0] == "output" && len(words) == 1:
+		candidates = formats
+	case words[0] == "put" && len(words) == 3:
+		candidates = []string{"string", "int64"}
+	case words[0] == "del" || (len(words) == 1 && (words[0] == "get" || words[0] == "put" || words[0] == "incr" || words[0] == "scan")):
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		defer cancel()
+		// Failures are silent, there is just nothing to complete
+		keys, _ := c.b.Scan(ctx, word, completionLimit)
+		return keys
+	}
+	var found []string
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, word) {
+			found = append(found, candidate)
+		}
+	}
+	return found
+}
+
+// splitArgs splits the line into words separated by spaces. Words can be in double or single quotes;
+// backslash escapes the next character except in single quotes.
+func splitArgs(line string) ([]string, error) {
+	var (
+		args  []string
+		word  strings.Builder
+		quote rune
+		// Whether there is a word, which can be an empty quoted one
+		inWord  bool
+		escaped bool
+	)
+	for _, r := range line {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote or escape")
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, nil
+}
+
+// quoteArg quotes the argument for splitArgs if it has spaces, quotes or backslashes.
+func quoteArg(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'\\") {
+		return arg
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
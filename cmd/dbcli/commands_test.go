@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+func TestSplitArgs(t *testing.T) {
+	for line, expected := range map[string][]string{
+		"":                        nil,
+		"  get   a ":              {"get", "a"},
+		`put "a b" 'c "d"'`:       {"put", "a b", `c "d"`},
+		`put a\ b ""`:             {"put", "a b", ""},
+		`put "x\"y" 'back\slash'`: {"put", `x"y`, `back\slash`},
+	} {
+		args, err := splitArgs(line)
+		if err != nil || !reflect.DeepEqual(args, expected) {
+			t.Errorf("splitArgs(%q) = %q, %v; expected %q", line, args, err, expected)
+		}
+	}
+	for _, line := range []string{`get "a`, `get a\`} {
+		if _, err := splitArgs(line); err == nil {
+			t.Errorf("No error for %q", line)
+		}
+	}
+	for _, arg := range []string{"a", "", "a b", `a"b'c\d`} {
+		if args, err := splitArgs(quoteArg(arg)); err != nil || len(args) != 1 || args[0] != arg {
+			t.Errorf("%q is quoted as %s", arg, quoteArg(arg))
+		}
+	}
+}
+
+func TestCommands(t *testing.T) {
+	db, err := datastore.NewDb("db", datastore.WithFS(datastore.NewMemFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	out := new(bytes.Buffer)
+	c := &cli{b: localBackend{db}, out: out, format: "table", timeout: time.Second}
+
+	for _, tc := range []struct {
+		line     string
+		expected string
+	}{
+		{`put a/1 one`, "OK\n"},
+		{`put "a/2 x" 5 int64`, "OK\n"},
+		{`incr "a/2 x" 2`, "7\n"},
+		{`incr b`, "1\n"},
+		{`get a/1`, "KEY  TYPE    VALUE\na/1  string  one\n"},
+		{`scan a/`, "KEY\na/1\na/2 x\n"},
+		{`del a/1 missing`, "Deleted 1 of 2 keys\n"},
+		{`output json`, ""},
+		{`get "a/2 x"`, `{"key":"a/2 x","type":"int64","value":"7"}` + "\n"},
+		{`scan a/ 1`, `{"keys":["a/2 x"]}` + "\n"},
+		{`stats`, `{"segments":1,"size":`},
+	} {
+		out.Reset()
+		if err := c.runLine(tc.line); err != nil {
+			t.Errorf("%s: %s", tc.line, err)
+		} else if !bytes.HasPrefix(out.Bytes(), []byte(tc.expected)) || (tc.line != "stats" && out.String() != tc.expected) {
+			t.Errorf("%s: unexpected output %q", tc.line, out)
+		}
+	}
+
+	if err := c.runLine("put max 9223372036854775807 int64"); err != nil {
+		t.Fatal(err)
+	}
+	for line, expected := range map[string]error{
+		"get a/1":         errNotFound,
+		"put a 1 float":   nil,
+		"put a x int64":   nil,
+		"get":             errUsage,
+		"incr a/1 x":      nil,
+		"incr max 1":      errOverflow,
+		"whatever":        nil,
+		`get "unfinished`: nil,
+	} {
+		err := c.runLine(line)
+		if err == nil || (expected != nil && !errors.Is(err, expected)) {
+			t.Errorf("%s: unexpected error %v", line, err)
+		}
+	}
+	if err := c.runLine("quit"); err != errQuit {
+		t.Errorf("quit returned %v", err)
+	}
+}
+
+func TestComplete(t *testing.T) {
+	db, err := datastore.NewDb("db", datastore.WithFS(datastore.NewMemFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"team", "teams/a", "other"} {
+		if err := db.Put(key, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := &cli{b: localBackend{db}, timeout: time.Second}
+
+	for line, expected := range map[string][]string{
+		"":            commands,
+		"s":           {"scan", "stats"},
+		"get te":      {"team", "teams/a"},
+		"del x team":  {"team", "teams/a"},
+		"get team ":   nil,
+		"output ":     formats,
+		"put k 1 i":   {"int64"},
+		"stats ":      nil,
+		"scan o":      {"other"},
+		"unknown te":  nil,
+		"incr nothin": nil,
+	} {
+		if candidates := c.complete(line); !reflect.DeepEqual(candidates, expected) {
+			t.Errorf("complete(%q) = %q, expected %q", line, candidates, expected)
+		}
+	}
+
+	editor := newLineEditor(nil, new(bytes.Buffer), c.complete)
+	for line, expected := range map[string]string{
+		"st":      "stats ",
+		"get tea": "get team",
+		"get o":   "get other ",
+		"get x":   "get x",
+	} {
+		if completed := string(editor.completeLine([]rune(line))); completed != expected {
+			t.Errorf("%q is completed as %q, expected %q", line, completed, expected)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// errInterrupted is returned by readLine on Ctrl-C.
+var errInterrupted = errors.New("interrupted")
+
+const (
+	keyCtrlC     = 3
+	keyCtrlD     = 4
+	keyTab       = 9
+	keyEnter     = 13
+	keyCtrlU     = 21
+	keyEscape    = 27
+	keyBackspace = 127
+	keyCtrlH     = 8
+)
+
+// lineEditor reads lines from a terminal in raw mode. The cursor always stays at the end of the line;
+// there are backspace, Ctrl-U to clear the line, the up and down arrows to go through the history
+// and tab to complete the last word.
+type lineEditor struct {
+	in  *bufio.Reader
+	out io.Writer
+	// complete returns the candidates for the last word of the line
+	complete func(line string) []string
+
+	history []string
+}
+
+func newLineEditor(in io.Reader, out io.Writer, complete func(line string) []string) *lineEditor {
+	return &lineEditor{in: bufio.NewReader(in), out: out, complete: complete}
+}
+
+// readLine prints the prompt and returns the line once enter is pressed.
+// It returns io.EOF on Ctrl-D at an empty line and errInterrupted on Ctrl-C.
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	var line []rune
+	// Position in the history while going through it with the arrows, len(e.history) is the edited line
+	pos := len(e.history)
+	edited := ""
+	redraw := func() {
+		// Carriage return, the line, and erase to the end of the terminal line
+		fmt.Fprintf(e.out, "\r%s%s\x1b[K", prompt, string(line))
+	}
+	redraw()
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case keyEnter, '\n':
+			fmt.Fprint(e.out, "\r\n")
+			s := string(line)
+			if strings.TrimSpace(s) != "" && (len(e.history) == 0 || e.history[len(e.history)-1] != s) {
+				e.history = append(e.history, s)
+			}
+			return s, nil
+		case keyCtrlC:
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errInterrupted
+		case keyCtrlD:
+			if len(line) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+		case keyBackspace, keyCtrlH:
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+			}
+		case keyCtrlU:
+			line = line[:0]
+		case keyTab:
+			line = e.completeLine(line)
+		case keyEscape:
+			seq, err := e.readEscape()
+			if err != nil {
+				return "", err
+			}
+			switch {
+			case seq == "[A" && pos > 0:
+				if pos == len(e.history) {
+					edited = string(line)
+				}
+				pos--
+				line = []rune(e.history[pos])
+			case seq == "[B" && pos < len(e.history):
+				pos++
+				if pos == len(e.history) {
+					line = []rune(edited)
+				} else {
+					line = []rune(e.history[pos])
+				}
+			}
+		default:
+			if r >= ' ' {
+				line = append(line, r)
+			}
+		}
+		redraw()
+	}
+}
+
+// readEscape reads the rest of an escape sequence, such as "[A" of the up arrow.
+func (e *lineEditor) readEscape() (string, error) {
+	r, _, err := e.in.ReadRune()
+	if err != nil || (r != '[' && r != 'O') {
+		return string(r), err
+	}
+	seq := []rune{r}
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		seq = append(seq, r)
+		// Parameters and intermediate bytes come before the final byte
+		if r >= 0x40 && r <= 0x7e {
+			return string(seq), nil
+		}
+	}
+}
+
+// completeLine completes the last word of the line with the only candidate or with the common prefix of all.
+// If that adds nothing, the candidates are listed below the line.
+func (e *lineEditor) completeLine(line []rune) []rune {
+	s := string(line)
+	candidates := e.complete(s)
+	if len(candidates) == 0 {
+		return line
+	}
+	word := s[strings.LastIndexAny(s, " \t")+1:]
+	if len(candidates) == 1 {
+		return []rune(s[:len(s)-len(word)] + quoteArg(candidates[0]) + " ")
+	}
+	if prefix := commonPrefix(candidates); len(prefix) > len(word) && quoteArg(prefix) == prefix {
+		return []rune(s + strings.TrimPrefix(prefix, word))
+	}
+	sort.Strings(candidates)
+	fmt.Fprintf(e.out, "\r\n%s\r\n", strings.Join(candidates, "  "))
+	return line
+}
+
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, w := range words[1:] {
+		for !strings.HasPrefix(w, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+	"github.com/roman-mazur/design-practice-2-template/dbclient"
+)
+
+var (
+	serviceURL = flag.String("url", "http://localhost:8100", "URL of the db service")
+	dir        = flag.String("dir", "", "database directory to open instead of connecting to the service")
+	readOnly   = flag.Bool("read-only", false, "open the directory of -dir in read-only mode, so a server can keep using it")
+	tokenFile  = flag.String("token-file", "", "file with the bearer token for the service")
+	output     = flag.String("output", "table", "output format: table or json")
+	timeout    = flag.Duration("timeout", 10*time.Second, "timeout of a command")
+)
+
+const usage = `Usage: dbcli [-url url | -dir path] [command [args]]
+
+Runs a single command given as arguments, or reads commands from the standard input.
+On a terminal there are a prompt, history and tab completion of commands and keys.
+
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage+commandsHelp+"\nFlags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	log.SetFlags(0)
+	if *output != "table" && *output != "json" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	b, err := openBackend()
+	if err != nil {
+		log.Fatal(err)
+	}
+	c := &cli{b: b, out: os.Stdout, format: *output, timeout: *timeout}
+	ok := true
+	if flag.NArg() > 0 {
+		if err := c.run(flag.Args()); err != nil && err != errQuit {
+			log.Print(err)
+			ok = false
+		}
+	} else if restore, err := makeRaw(int(os.Stdin.Fd())); err == nil {
+		interactive(c, restore)
+	} else {
+		ok = runLines(c, os.Stdin)
+	}
+	if err := b.Close(); err != nil {
+		log.Fatal(err)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+func openBackend() (backend, error) {
+	if *dir != "" {
+		var opts []datastore.Option
+		if *readOnly {
+			opts = append(opts, datastore.ReadOnly())
+		}
+		db, err := datastore.NewDb(*dir, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return localBackend{db}, nil
+	}
+	var opts []dbclient.Option
+	if *tokenFile != "" {
+		token, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read the token: %w", err)
+		}
+		opts = append(opts, dbclient.WithToken(strings.TrimSpace(string(token))))
+	}
+	return httpBackend{dbclient.New(strings.TrimSuffix(*serviceURL, "/"), opts...)}, nil
+}
+
+// runLines runs the commands of the lines of r without prompts. It reports whether all succeeded.
+func runLines(c *cli, r io.Reader) bool {
+	ok := true
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		err := c.runLine(scanner.Text())
+		if err == errQuit {
+			break
+		}
+		if err != nil {
+			log.Print(err)
+			ok = false
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Print(err)
+		ok = false
+	}
+	return ok
+}
+
+// interactive reads commands with a line editor until quit or Ctrl-D. The terminal is in raw mode
+// only while a line is read, so the output of commands and Ctrl-C during them work as usual.
+func interactive(c *cli, restore func()) {
+	prompt := "db> "
+	if *dir != "" {
+		prompt = *dir + "> "
+	}
+	editor := newLineEditor(os.Stdin, os.Stdout, c.complete)
+	for {
+		line, err := editor.readLine(prompt)
+		restore()
+		switch {
+		case err == errInterrupted:
+			// Ctrl-C drops the line
+		case err == io.EOF:
+			return
+		case err != nil:
+			log.Print(err)
+			return
+		default:
+			err = c.runLine(line)
+			if err == errQuit {
+				return
+			}
+			if err != nil {
+				log.Print(err)
+			}
+		}
+		if restore, err = makeRaw(int(os.Stdin.Fd())); err != nil {
+			log.Print(err)
+			return
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+var dir = flag.String("dir", "./out", "database directory")
+
+const usage = `Usage: dbtool [-dir path] <command> [args]
+
+Commands:
+  dump           print every stored record (segment, offset, sequence number, time, key, type, value)
+  verify         check the structure and checksums of all segments
+  compact        merge all segments into one
+  stats          print the number of segments, their size and the number of keys
+  export [file]  write the current values as JSON lines (to stdout by default)
+  import [file]  put values from JSON lines (from stdin by default)
+`
+
+// jsonRecord is a single line of the export format.
+type jsonRecord struct {
+	Key   string          `json:"key"`
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch cmd, args := flag.Arg(0), flag.Args()[1:]; cmd {
+	case "dump":
+		err = dump(os.Stdout)
+	case "verify":
+		err = verify(os.Stdout)
+	case "compact":
+		err = withDb(func(db *datastore.Db) error {
+			return db.Compact()
+		})
+	case "stats":
+		err = withDb(func(db *datastore.Db) error {
+			return printStats(os.Stdout, db)
+		}, datastore.ReadOnly())
+	case "export":
+		err = withFile(args, os.Stdout, os.Create, func(f *os.File) error {
+			return withDb(func(db *datastore.Db) error {
+				return export(f, db)
+			}, datastore.ReadOnly())
+		})
+	case "import":
+		err = withFile(args, os.Stdin, os.Open, func(f *os.File) error {
+			return withDb(func(db *datastore.Db) error {
+				n, err := importRecords(f, db)
+				log.Printf("Imported %d records", n)
+				return err
+			})
+		})
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// withDb opens the database for the duration of fn.
+// Commands that only read it open it in read-only mode, so they also work while a server is using the directory.
+func withDb(fn func(db *datastore.Db) error, opts ...datastore.Option) error {
+	db, err := datastore.NewDb(*dir, opts...)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return fn(db)
+}
+
+// withFile opens the file named by the first argument or falls back to def if there is none.
+func withFile(args []string, def *os.File, open func(string) (*os.File, error), fn func(*os.File) error) error {
+	if len(args) == 0 {
+		return fn(def)
+	}
+	f, err := open(args[0])
+	if err != nil {
+		return err
+	}
+	err = fn(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func dump(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SEGMENT\tOFFSET\tSEQ\tTIME\tKEY\tTYPE\tVALUE")
+	err := datastore.Walk(*dir, func(r datastore.Record) error {
+		_, err := fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\t%q\n",
+			r.Segment, r.Offset, r.Seq, r.Timestamp.Format(time.RFC3339Nano), r.Key, r.Type, r.Value)
+		return err
+	})
+	if ferr := w.Flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+func verify(out io.Writer) error {
+	problems, err := datastore.Verify(*dir)
+	if err != nil {
+		return err
+	}
+	for _, p := range problems {
+		fmt.Fprintln(out, p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d damaged segments", len(problems))
+	}
+	fmt.Fprintln(out, "OK")
+	return nil
+}
+
+func printStats(out io.Writer, db *datastore.Db) error {
+	stats, err := db.Stats()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "segments: %d\nsize: %d\nkeys: %d\n", stats.Segments, stats.Size, stats.Keys)
+	return nil
+}
+
+func export(out io.Writer, db *datastore.Db) error {
+	w := bufio.NewWriter(out)
+	enc := json.NewEncoder(w)
+	for _, key := range db.Keys() {
+		value, vType, err := db.Lookup(key)
+		if err != nil {
+			return err
+		}
+		raw := json.RawMessage(value)
+		if vType == "string" {
+			raw, err = json.Marshal(value)
+			if err != nil {
+				return err
+			}
+		}
+		if err := enc.Encode(jsonRecord{key, vType, raw}); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func importRecords(in io.Reader, db *datastore.Db) (int, error) {
+	dec := json.NewDecoder(in)
+	n := 0
+	for dec.More() {
+		var r jsonRecord
+		if err := dec.Decode(&r); err != nil {
+			return n, err
+		}
+		if err := putRecord(db, r); err != nil {
+			return n, fmt.Errorf("record %d (%s): %w", n+1, r.Key, err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+func putRecord(db *datastore.Db, r jsonRecord) error {
+	switch r.Type {
+	case "", "string":
+		var value string
+		if err := json.Unmarshal(r.Value, &value); err != nil {
+			return err
+		}
+		return db.Put(r.Key, value)
+	case "int64":
+		value, err := strconv.ParseInt(string(r.Value), 10, 64)
+		if err != nil {
+			return err
+		}
+		return db.PutInt64(r.Key, value)
+	default:
+		return fmt.Errorf("unknown data type %q", r.Type)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+// newTestDir makes the directory of the commands a new database with a few values.
+func newTestDir(t *testing.T) {
+	*dir = t.TempDir()
+	db, err := datastore.NewDb(*dir, datastore.WithSegmentSize(60))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, err := range []error{
+		db.Put("a", "first"),
+		db.Put("a", "second \"quoted\""),
+		db.PutInt64("n", -5),
+		db.Put("b", "x"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestVerifyAndDump(t *testing.T) {
+	newTestDir(t)
+	var out bytes.Buffer
+	if err := verify(&out); err != nil || out.String() != "OK\n" {
+		t.Errorf("Unexpected verify result %q: %v", out.String(), err)
+	}
+	out.Reset()
+	if err := dump(&out); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 5 || !strings.Contains(lines[3], "int64") {
+		t.Errorf("Unexpected dump:\n%s", out.String())
+	}
+
+	// Damage the value of the first record
+	segment := filepath.Join(*dir, "segment-1")
+	data, err := os.ReadFile(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-6] ^= 0xff
+	if err := os.WriteFile(segment, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := verify(&out); err == nil || !strings.Contains(out.String(), "segment-1") {
+		t.Errorf("Expected the damage to be found, got %q: %v", out.String(), err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	newTestDir(t)
+	stats := func() string {
+		var out bytes.Buffer
+		if err := withDb(func(db *datastore.Db) error {
+			return printStats(&out, db)
+		}, datastore.ReadOnly()); err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+	if s := stats(); strings.HasPrefix(s, "segments: 1\n") {
+		t.Fatalf("Expected several segments before compaction:\n%s", s)
+	}
+	if err := withDb(func(db *datastore.Db) error {
+		return db.Compact()
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if s := stats(); !strings.HasSuffix(s, "keys: 3\n") {
+		t.Errorf("Unexpected stats after compaction:\n%s", s)
+	}
+	var out bytes.Buffer
+	if err := verify(&out); err != nil {
+		t.Errorf("Compacted database is damaged: %s: %v", out.String(), err)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	newTestDir(t)
+	var exported bytes.Buffer
+	if err := withDb(func(db *datastore.Db) error {
+		return export(&exported, db)
+	}, datastore.ReadOnly()); err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"key":"a","type":"string","value":"second \"quoted\""}
+{"key":"b","type":"string","value":"x"}
+{"key":"n","type":"int64","value":-5}
+`
+	if exported.String() != expected {
+		t.Errorf("Unexpected export:\n%s", exported.String())
+	}
+
+	*dir = t.TempDir()
+	var n int
+	if err := withDb(func(db *datastore.Db) error {
+		var err error
+		n, err = importRecords(strings.NewReader(exported.String()+`{"key":"c","value":"default type"}`), db)
+		return err
+	}); err != nil || n != 4 {
+		t.Fatalf("Imported %d records: %v", n, err)
+	}
+	err := withDb(func(db *datastore.Db) error {
+		if value, err := db.GetInt64("n"); err != nil || value != -5 {
+			t.Errorf("Bad imported value %d: %v", value, err)
+		}
+		if value, err := db.Get("c"); err != nil || value != "default type" {
+			t.Errorf("Bad imported value %q: %v", value, err)
+		}
+		return nil
+	}, datastore.ReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = withDb(func(db *datastore.Db) error {
+		_, err := importRecords(strings.NewReader(`{"key":"d","type":"float","value":1}`), db)
+		return err
+	})
+	if err == nil || !strings.Contains(err.Error(), "record 1 (d)") {
+		t.Errorf("Expected the bad record to be reported, got %v", err)
+	}
+}
@@ -186,5 +186,6 @@ func main() {
 	log.Printf("Tracing support enabled: %t", *traceEnabled)
 	log.Printf("Timeout: %d seconds", *timeoutSec)
 	frontend.Start()
+	signal.OnShutdown("HTTP server", frontend.Shutdown)
 	signal.WaitForTerminationSignal()
 }
@@ -2,14 +2,18 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
-	"io"
-	"io/ioutil"
+	"fmt"
+	"log"
 	"net/http"
-	"net/url"
+	"os"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/roman-mazur/design-practice-2-template/dbclient"
 	"github.com/roman-mazur/design-practice-2-template/httptools"
 	"github.com/roman-mazur/design-practice-2-template/signal"
 )
@@ -19,6 +23,7 @@ var delay = flag.Int("delay", 0, "response delay in millseconds")
 var healthInit = flag.Bool("health", true, "initial server health")
 var debug = flag.Bool("debug", false, "whether we can change server's health status")
 var dbUrl = flag.String("db-url", "db:8100", "hostname of database service")
+var dbTokenFile = flag.String("db-token-file", "", "file with the bearer token of the database service")
 
 const scheme = "http"
 const team = "codebryksy"
@@ -42,11 +47,21 @@ func (c *boolMutex) Get() bool {
 }
 
 var report Report
+var dbClient *dbclient.Client
 
 func main() {
 	flag.Parse()
 	h := new(http.ServeMux)
 	health := boolMutex{v: *healthInit}
+	var opts []dbclient.Option
+	if *dbTokenFile != "" {
+		token, err := os.ReadFile(*dbTokenFile)
+		if err != nil {
+			log.Fatalf("Failed to read the database token: %s", err)
+		}
+		opts = append(opts, dbclient.WithToken(strings.TrimSpace(string(token))))
+	}
+	dbClient = dbclient.New(scheme+"://"+*dbUrl, opts...)
 	writeTeam()
 
 	if *debug {
@@ -78,17 +93,15 @@ func main() {
 
 	server := httptools.CreateServer(*port, h)
 	server.Start()
+	signal.OnShutdown("HTTP server", server.Shutdown)
 	signal.WaitForTerminationSignal()
 }
 
 func writeTeam() {
-	path := scheme + "://" + *dbUrl + "/db/" + team
-	formData := url.Values{}
-	formData.Set("value", time.Now().Format("2006-01-02"))
-
-	resp, err := http.PostForm(path, formData)
-	if err != nil || resp.StatusCode != http.StatusOK {
-		panic("Can't initiate DB")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := dbClient.Put(ctx, team, time.Now().Format("2006-01-02")); err != nil {
+		panic(fmt.Sprintf("Can't initiate DB: %s", err))
 	}
 }
 
@@ -97,34 +110,25 @@ func handleDefaultGet(rw http.ResponseWriter, r *http.Request) {
 
 	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(10)*time.Second)
 	defer cancel()
-	fwdRequest := r.Clone(ctx)
-	fwdRequest.RequestURI = ""
-	fwdRequest.URL.Host = *dbUrl
-	fwdRequest.Host = *dbUrl
-	fwdRequest.URL.Scheme = scheme
-	fwdRequest.URL.Path = "/db/" + key
-
-	resp, err := http.DefaultClient.Do(fwdRequest)
+	value, err := dbClient.Get(ctx, key)
 	if *delay > 0 && *delay < 300 {
 		time.Sleep(time.Duration(*delay) * time.Millisecond)
 	}
+	if errors.Is(err, dbclient.ErrNotFound) {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if resp.StatusCode == http.StatusBadRequest {
-		body, err := ioutil.ReadAll(resp.Body)
-		if err == nil && string(body) == "record does not exist\n" {
-			rw.WriteHeader(http.StatusNotFound)
-			return
-		}
-	}
 
 	report.Process(r)
 
-	rw.WriteHeader(resp.StatusCode)
-	rw.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
-	rw.Header().Set("Content-Length", resp.Header.Get("Content-Length"))
-	io.Copy(rw, resp.Body)
-	resp.Body.Close()
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	}{key, value})
 }
@@ -4,48 +4,88 @@ import (
 	"bufio"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var ErrNotFound = fmt.Errorf("record does not exist")
+// version locates a single write of a key inside a block.
+type version struct {
+	seq       uint64
+	timestamp int64
+	offset    int64
+	// The key is deleted by this write
+	tombstone bool
+}
 
-type hashIndex map[string]int64
+// hashIndex maps every key to its versions stored in a block, oldest first.
+type hashIndex map[string][]version
 
 type block struct {
 	index   hashIndex
-	segment *os.File
+	fs      FS
+	segment File
 
 	outPath   string
 	outOffset int64
-	mu        sync.RWMutex
+	// The biggest sequence number written to the block
+	lastSeq uint64
+	mu      sync.RWMutex
 
 	writeCh chan writeArgument
+	// Numbers records written without a sequence number, shared by all blocks of a Db
+	seq *atomic.Uint64
+	// Sync the segment after every write
+	syncWrites bool
+	// Called by the writer with every written record and its offset, in the order they are written
+	onWrite func(b *block, e *entry, offset int64)
 
 	cancel context.CancelFunc
 }
 
-func newBlock(dir string, outFileName string) (*block, error) {
-	outputPath := filepath.Join(dir, outFileName)
-	f, err := os.OpenFile(outputPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+func newBlock(fs FS, dir string, outFileName string) (*block, error) {
+	return openBlock(fs, filepath.Join(dir, outFileName), os.O_APPEND|os.O_RDWR|os.O_CREATE, false)
+}
+
+// newReadOnlyBlock opens an existing segment without starting a writer for it.
+func newReadOnlyBlock(fs FS, dir string, outFileName string) (*block, error) {
+	return openBlock(fs, filepath.Join(dir, outFileName), os.O_RDONLY, false)
+}
+
+// newReadOnlyTailBlock is newReadOnlyBlock for the active segment of a database which can be written meanwhile.
+// A torn record at its end is left out, it can be the one being written.
+func newReadOnlyTailBlock(fs FS, dir string, outFileName string) (*block, error) {
+	return openBlock(fs, filepath.Join(dir, outFileName), os.O_RDONLY, true)
+}
+
+func openBlock(fs FS, outputPath string, flag int, ignoreTorn bool) (*block, error) {
+	f, err := fs.OpenFile(outputPath, flag, 0o600)
 	if err != nil {
 		return nil, err
 	}
 	bl := &block{
 		index:   make(hashIndex),
+		fs:      fs,
 		segment: f,
 
 		outPath: outputPath,
-		writeCh: make(chan writeArgument),
 	}
-	ctx, cancel := context.WithCancel(context.Background())
-	bl.cancel = cancel
-	go bl.write(ctx)
-	err = bl.recover()
-	if err != nil && err != io.EOF {
+	if flag != os.O_RDONLY {
+		bl.writeCh = make(chan writeArgument)
+		ctx, cancel := context.WithCancel(context.Background())
+		bl.cancel = cancel
+		go bl.write(ctx)
+	}
+	err = bl.recover(ignoreTorn)
+	if err != nil {
+		bl.close()
 		return nil, err
 	}
 	return bl, nil
@@ -53,114 +93,238 @@ func newBlock(dir string, outFileName string) (*block, error) {
 
 const bufSize = 8192
 
-func (b *block) recover() error {
-	input, err := os.Open(b.outPath)
+// recover indexes the records of the segment, stopping at a torn record at its end if ignoreTorn is set.
+func (b *block) recover(ignoreTorn bool) error {
+	info, err := b.segment.Stat()
 	if err != nil {
 		return err
 	}
-	defer input.Close()
-
-	var buf [bufSize]byte
-	in := bufio.NewReaderSize(input, bufSize)
-	for err == nil {
-		var (
-			header, data []byte
-			n            int
-		)
-		header, err = in.Peek(bufSize)
-		if err == io.EOF {
-			if len(header) == 0 {
-				return err
-			}
-		} else if err != nil {
-			return err
+	input := io.NewSectionReader(b.segment, 0, info.Size())
+	err = scanRecords(input, info.Size(), func(offset int64, data []byte) error {
+		if err := validate(data); err != nil {
+			return &recordError{offset, err}
 		}
-		size := binary.LittleEndian.Uint32(header)
+		var e entry
+		e.Decode(data)
+		b.addVersion(&e, offset)
+		b.outOffset = offset + int64(len(data))
+		return nil
+	})
+	if ignoreTorn && errors.Is(err, errTorn) {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("corrupted file %s: %w", b.outPath, err)
+	}
+	return nil
+}
 
-		if size < bufSize {
-			data = buf[:size]
-		} else {
-			data = make([]byte, size)
-		}
-		n, err = in.Read(data)
+// recordError reports a damaged record found at the given offset of a segment.
+type recordError struct {
+	offset int64
+	err    error
+}
 
-		if err == nil {
-			if n != int(size) {
-				return fmt.Errorf("corrupted file")
-			}
+func (e *recordError) Error() string {
+	return fmt.Sprintf("offset %d: %s", e.offset, e.err)
+}
 
-			var e entry
-			e.Decode(data)
-			b.index[e.key] = b.outOffset
-			b.outOffset += int64(n)
+func (e *recordError) Unwrap() error {
+	return e.err
+}
+
+func (e *recordError) Is(target error) bool {
+	return target == ErrCorrupted
+}
+
+// errTorn marks a record cut off by the end of a segment.
+var errTorn = errors.New("torn record")
+
+// scanRecords reads consecutive records from the first limit bytes of in
+// and calls fn with the offset and the raw bytes of each of them.
+func scanRecords(in io.Reader, limit int64, fn func(offset int64, data []byte) error) error {
+	reader := bufio.NewReaderSize(in, bufSize)
+	var (
+		offset int64
+		header [4]byte
+	)
+	for offset < limit {
+		if limit-offset < int64(len(header)) {
+			return &recordError{offset, fmt.Errorf("%w: %d bytes left for the header", errTorn, limit-offset)}
+		}
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			return &recordError{offset, fmt.Errorf("truncated record header: %w", err)}
+		}
+		size := int64(binary.LittleEndian.Uint32(header[:]))
+		if size < minEntrySize {
+			return &recordError{offset, fmt.Errorf("invalid record size %d", size)}
 		}
+		if size > limit-offset {
+			return &recordError{offset, fmt.Errorf("%w: record size %d, %d bytes left", errTorn, size, limit-offset)}
+		}
+		data := make([]byte, size)
+		copy(data, header[:])
+		if _, err := io.ReadFull(reader, data[len(header):]); err != nil {
+			return &recordError{offset, fmt.Errorf("truncated record: %w", err)}
+		}
+		if err := fn(offset, data); err != nil {
+			return err
+		}
+		offset += size
+	}
+	return nil
+}
+
+// cutTornTail removes the torn record from the end of a segment.
+func cutTornTail(fs FS, path string) error {
+	f, err := fs.OpenFile(path, os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err == nil {
+		err = scanRecords(io.NewSectionReader(f, 0, info.Size()), info.Size(), func(int64, []byte) error {
+			return nil
+		})
+	}
+	var re *recordError
+	if errors.As(err, &re) && errors.Is(err, errTorn) {
+		err = f.Truncate(re.offset)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
 	}
 	return err
 }
 
 func (b *block) close() error {
-	b.cancel()
-	close(b.writeCh)
+	if b.writeCh != nil {
+		b.cancel()
+		close(b.writeCh)
+	}
 	return b.segment.Close()
 }
 
-func (b *block) get(key string) (string, string, error) {
+func (b *block) addVersion(e *entry, offset int64) {
+	b.index[e.key] = append(b.index[e.key], version{e.seq, e.timestamp, offset, e.vType == TOMBSTONE_TYPE})
+	if e.seq > b.lastSeq {
+		b.lastSeq = e.seq
+	}
+}
+
+// versions returns all versions of the key stored in the block, oldest first.
+func (b *block) versions(key string) []version {
 	b.mu.RLock()
-	position, ok := b.index[key]
-	b.mu.RUnlock()
-	if !ok {
+	defer b.mu.RUnlock()
+	vs := b.index[key]
+	return vs[:len(vs):len(vs)]
+}
+
+func (b *block) get(key string) (string, string, error) {
+	vs := b.versions(key)
+	if len(vs) == 0 {
 		return "", "", ErrNotFound
 	}
-
-	file, err := os.Open(b.outPath)
+	pair, err := b.read(vs[len(vs)-1].offset)
 	if err != nil {
 		return "", "", err
 	}
-	defer file.Close()
+	return pair.value, pair.vType, nil
+}
 
-	_, err = file.Seek(position, 0)
-	if err != nil {
-		return "", "", err
-	}
+// read returns the value of the record at the given position.
+// It reads through the already opened segment, so the block stays readable even after its file is removed.
+func (b *block) read(position int64) (output, error) {
+	b.mu.RLock()
+	end := b.outOffset
+	b.mu.RUnlock()
+	return readRecord(b.segment, position, end)
+}
 
-	reader := bufio.NewReader(file)
-	pair, err := readValue(reader)
-	if err != nil {
-		return "", "", err
+// readRecord returns the value of the record at the given position of a segment written up to end.
+func readRecord(segment File, position, end int64) (output, error) {
+	var header [4]byte
+	if _, err := segment.ReadAt(header[:], position); err != nil {
+		return output{}, err
+	}
+	if size := int64(binary.LittleEndian.Uint32(header[:])); size > end-position {
+		return output{}, &recordError{position, fmt.Errorf("record size %d exceeds the segment", size)}
 	}
+	reader := bufio.NewReader(io.NewSectionReader(segment, position, end-position))
+	return readValue(reader)
+}
 
-	return pair.value, pair.vType, nil
+// put appends the record e and returns how long it waited for the writer.
+func (b *block) put(ctx context.Context, e entry) (time.Duration, error) {
+	return b.append(ctx, e, func(w io.Writer, e *entry) (int64, error) {
+		n, err := w.Write(e.Encode())
+		return int64(n), err
+	})
 }
 
-func (b *block) put(key, vType, value string) error {
-	e := entry{
-		key:   key,
-		vType: ToByte(vType),
-		value: value,
-	}
+// update appends the record e after prepare fills it in from the current state of the database.
+// prepare runs in the writer, so no other write to the active block can come in between,
+// and the record isn't written if it fails.
+func (b *block) update(ctx context.Context, e entry, prepare func(e *entry) error) (time.Duration, error) {
+	return b.send(ctx, writeArgument{e: &e, prepare: prepare, write: func(w io.Writer, e *entry) (int64, error) {
+		n, err := w.Write(e.Encode())
+		return int64(n), err
+	}})
+}
 
-	resultCh := make(chan writeResult)
-	b.writeCh <- writeArgument{resultCh, e.Encode()}
-	result := <-resultCh
-	close(resultCh)
+// putStream appends a string record with a value of the given size read from r.
+func (b *block) putStream(ctx context.Context, e entry, r io.Reader, size int64) (time.Duration, error) {
+	return b.append(ctx, e, func(w io.Writer, e *entry) (int64, error) {
+		sum := crc32.NewIEEE()
+		out := io.MultiWriter(w, sum)
+		n, err := out.Write(encodeStringHeader(e, int(size)))
+		written := int64(n)
+		if err != nil {
+			return written, err
+		}
+		m, err := io.CopyN(out, r, size)
+		written += m
+		if err != nil {
+			return written, err
+		}
+		var checksum [checksumSize]byte
+		binary.LittleEndian.PutUint32(checksum[:], sum.Sum32())
+		n, err = w.Write(checksum[:])
+		return written + int64(n), err
+	})
+}
 
-	if result.err == nil {
-		b.mu.Lock()
-		b.index[key] = b.outOffset
-		b.outOffset += int64(result.n)
-		b.mu.Unlock()
-	}
+// append hands the record e over to the writer goroutine, which numbers it, writes it with
+// the write function and indexes it. The record can only be abandoned through ctx while it waits
+// for the writer; once accepted, it is written anyway. append returns how long the record waited.
+func (b *block) append(ctx context.Context, e entry, write func(w io.Writer, e *entry) (int64, error)) (time.Duration, error) {
+	return b.send(ctx, writeArgument{e: &e, write: write})
+}
 
-	return result.err
+func (b *block) send(ctx context.Context, arg writeArgument) (time.Duration, error) {
+	resultCh := make(chan writeResult, 1)
+	arg.resultCh = resultCh
+	start := time.Now()
+	select {
+	case b.writeCh <- arg:
+	case <-ctx.Done():
+		return time.Since(start), ctx.Err()
+	}
+	queued := time.Since(start)
+	result := <-resultCh
+	return queued, result.err
 }
 
 type writeArgument struct {
 	resultCh chan writeResult
-	data     []byte
+	e        *entry
+	// Fills in the record right before it is written, if set
+	prepare func(e *entry) error
+	write   func(w io.Writer, e *entry) (int64, error)
 }
 
 type writeResult struct {
-	n   int
+	n   int64
 	err error
 }
 
@@ -169,15 +333,51 @@ func (b *block) write(ctx context.Context) {
 		select {
 		case <-ctx.Done():
 			return
-		case arg := <-b.writeCh:
-			n, err := b.segment.Write(arg.data)
+		case arg, ok := <-b.writeCh:
+			if !ok {
+				return
+			}
+			e := arg.e
+			if arg.prepare != nil {
+				if err := arg.prepare(e); err != nil {
+					arg.resultCh <- writeResult{0, err}
+					continue
+				}
+			}
+			if e.seq == 0 {
+				e.seq = b.seq.Add(1)
+				e.timestamp = time.Now().UnixNano()
+			}
+			n, err := arg.write(b.segment, e)
+			if err == nil && b.syncWrites {
+				err = b.segment.Sync()
+			}
+			b.mu.Lock()
+			offset := b.outOffset
+			if err == nil {
+				b.addVersion(e, b.outOffset)
+				b.outOffset += n
+			} else if n > 0 {
+				// Cut off the partially written record, so it doesn't break the segment
+				if terr := b.segment.Truncate(b.outOffset); terr != nil {
+					err = fmt.Errorf("%w (can't truncate the segment: %s)", err, terr)
+				}
+			}
+			b.mu.Unlock()
+			if err == nil && b.onWrite != nil {
+				b.onWrite(b, e, offset)
+			}
 			arg.resultCh <- writeResult{n, err}
 		}
 	}
 }
 
+func (b *block) sync() error {
+	return b.segment.Sync()
+}
+
 func (b *block) size() (int64, error) {
-	info, err := os.Stat(b.outPath)
+	info, err := b.fs.Stat(b.outPath)
 	if err != nil {
 		return 0, err
 	}
@@ -185,39 +385,83 @@ func (b *block) size() (int64, error) {
 	return currentSize, nil
 }
 
-func mergeAll(blocks []*block) (*block, error) {
+// retention decides which versions of a key survive a merge.
+type retention struct {
+	// The number of the most recent versions to keep
+	versions int
+	// Versions younger than this are kept regardless of their number
+	window time.Duration
+}
+
+// keep filters versions of a single key ordered from the oldest to the newest.
+// The latest version is always kept.
+func (r retention) keep(vs []located, now time.Time) []located {
+	cutoff := now.Add(-r.window).UnixNano()
+	var kept []located
+	for i, v := range vs {
+		if len(vs)-i <= r.versions || i == len(vs)-1 || (r.window > 0 && v.timestamp >= cutoff) {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// located is a version together with the block it is stored in.
+type located struct {
+	version
+	b *block
+}
+
+// mergeAll writes the versions of keys from the blocks kept by r to a new segment.
+func mergeAll(fs FS, dir, outFileName string, blocks []*block, r retention) (*block, error) {
 	if len(blocks) == 0 {
 		return nil, fmt.Errorf("empty array of blocks")
 	}
-	newBlock, err := newBlock(blocks[0].outPath+"-temp", "")
+	newBlock, err := newBlock(fs, dir, outFileName)
 	if err != nil {
 		return nil, err
 	}
-	for j := len(blocks) - 1; j >= 0; j = j - 1 {
-		err = mergePair(newBlock, blocks[j])
-		if err != nil {
-			return nil, err
+
+	history := make(map[string][]located)
+	for _, b := range blocks {
+		for key, vs := range b.index {
+			for _, v := range vs {
+				history[key] = append(history[key], located{v, b})
+			}
 		}
 	}
-	return newBlock, nil
-}
-
-func mergePair(destBlock, srcBlock *block) error {
-	for key := range srcBlock.index {
-		_, ok := destBlock.index[key]
-		if !ok {
-			val, vType, err := srcBlock.get(key)
+	keys := make([]string, 0, len(history))
+	for key := range history {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	now := time.Now()
+	for _, key := range keys {
+		kept := r.keep(history[key], now)
+		if len(kept) == 1 && kept[0].tombstone {
+			// The merged blocks are the oldest ones, so there is nothing left for the tombstone to hide
+			continue
+		}
+		for _, v := range kept {
+			pair, err := v.b.read(v.offset)
 			if err != nil {
-				return err
+				newBlock.delete()
+				return nil, err
+			}
+			e := entry{key, ToByte(pair.vType), pair.value, v.seq, v.timestamp}
+			if _, err := newBlock.put(context.Background(), e); err != nil {
+				newBlock.delete()
+				return nil, err
 			}
-			destBlock.put(key, vType, val)
 		}
 	}
-	return nil
+	return newBlock, nil
 }
 
 func (b *block) delete() error {
-	err := os.Remove(b.segment.Name())
+	b.close()
+	err := b.fs.Remove(b.outPath)
 	if err != nil {
 		return err
 	}
@@ -1,186 +1,577 @@
 package datastore
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"path/filepath"
-	"regexp"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const outFileName = "segment-"
 
+// The file locked by a Db to claim its directory
+const lockFileName = "LOCK"
+
 // 10 MB = 10000000 Bytes (in decimal)
 // 10 MB = 10485760 Bytes (in binary)
 const outFileSize int64 = 10000000
 
+const (
+	DefaultSegmentSize  = outFileSize
+	DefaultMaxKeySize   = 64 << 10
+	DefaultMaxValueSize = 64 << 20
+	// Keys and values are limited by the 32-bit lengths of records
+	maxEncodableSize = math.MaxUint32 - minEntrySize - 4
+)
+
 type Db struct {
+	// захищає список блоків від зміни під час читання
+	mu     sync.RWMutex
 	blocks []*block
 	//директорія, де зберігатимуться всі сегменти
 	dir           string
+	fs            FS
 	segmentName   string
 	segmentNumber int
 	segmentSize   int64
+	// The number of inactive segments that triggers a merge, merges are manual if 0
+	mergeThreshold int
+	syncWrites     bool
+	// Period of syncing the active segment, if positive
+	syncInterval time.Duration
+	// Stops the periodic sync
+	stopSync chan struct{}
+	// Sequence number of the last write
+	seq atomic.Uint64
+	// Which old versions of keys are kept through merges
+	retention retention
+
+	maxKeySize   int64
+	maxValueSize int64
+	// Limit of the total size of segments, if positive
+	maxDiskSize int64
+	// The size of segments after the last compaction made for the quota
+	compactedSize int64
+	// The space taken by writes which passed the quota check and aren't finished yet, guarded by quotaMu
+	quotaMu  sync.Mutex
+	reserved int64
+
+	// Notified about finished operations, if set
+	observer Observer
+
+	// Channels closed by the next write of their keys, see Wait
+	watchMu  sync.Mutex
+	watchers map[string]chan struct{}
+
+	// Secondary indexes by name. Changing the set of indexes takes mu as well
+	indexMu sync.RWMutex
+	indexes map[string]*fieldIndex
+
+	readOnly bool
+	closed   bool
+	// Holds the directory lock while the Db is open for writing
+	lock io.Closer
 }
 
-func NewDb(dir string) (*Db, error) {
+func NewDb(dir string, opts ...Option) (*Db, error) {
 	db := &Db{
-		dir:         dir,
-		segmentName: outFileName,
-		segmentSize: outFileSize,
-	}
+		dir:            dir,
+		fs:             OS,
+		segmentName:    outFileName,
+		segmentSize:    outFileSize,
+		mergeThreshold: 2,
+		retention:      retention{versions: 1},
+		indexes:        make(map[string]*fieldIndex),
 
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		os.MkdirAll(dir, os.ModePerm)
+		maxKeySize:   DefaultMaxKeySize,
+		maxValueSize: DefaultMaxValueSize,
 	}
-	f, err := os.Open(dir)
-	if err != nil {
-		return nil, err
+	for _, opt := range opts {
+		opt(db)
 	}
-	defer f.Close()
-
-	filesNames, err := f.Readdirnames(0)
-	if err != nil {
-		return nil, err
+	if db.maxKeySize+db.maxValueSize > maxEncodableSize {
+		return nil, fmt.Errorf("key and value size limits can't exceed %d bytes together", int64(maxEncodableSize))
 	}
 
-	//якщо директорія не порожня -> викликаємо рекавер
-	if len(filesNames) != 0 {
-		err := db.recover(filesNames)
-		if err != nil {
-			return nil, err
+	if !db.readOnly {
+		if _, err := db.fs.Stat(dir); os.IsNotExist(err) {
+			db.fs.MkdirAll(dir, os.ModePerm)
 		}
-	} else {
-		// директорія порожня -> створюємо перший блок
-		err = db.addNewBlockToDb()
+		lock, err := db.fs.Lock(filepath.Join(dir, lockFileName))
 		if err != nil {
 			return nil, err
 		}
+		db.lock = lock
+	}
+
+	err := db.upgrade()
+	var filesNames []string
+	if err == nil {
+		filesNames, err = listSegments(db.fs, dir)
+	}
+	if err == nil {
+		err = db.recover(filesNames)
+	}
+	if err == nil {
+		err = db.loadIndexes()
+	}
+	if err == nil && !db.readOnly {
+		//якщо сегментів немає -> створюємо перший блок
+		if len(db.blocks) == 0 {
+			err = db.addNewBlockToDb()
+		} else {
+			err = db.writeManifest()
+		}
+	}
+	if err == nil && !db.readOnly {
+		err = db.removeOrphans()
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if db.syncInterval > 0 && !db.readOnly {
+		db.stopSync = make(chan struct{})
+		go db.syncPeriodically(db.stopSync)
 	}
 
 	return db, nil
 }
 
 func (db *Db) addNewBlockToDb() error {
-	db.segmentNumber++
-	b, err := newBlock(db.dir,
-		db.segmentName+strconv.Itoa((db.segmentNumber)))
+	b, err := newBlock(db.fs, db.dir, db.nextSegmentName())
 	if err != nil {
 		return err
 	}
+	b.seq = &db.seq
+	b.onWrite = db.index
+	b.syncWrites = db.syncWrites
 	db.blocks = append(db.blocks, b)
+	err = db.writeManifest()
+	if err != nil {
+		db.blocks = db.blocks[:len(db.blocks)-1]
+		b.delete()
+		return err
+	}
 	return nil
 }
 
-func (db *Db) recover(filesNames []string) error {
-	//сортуємо за зростанням
-	sort.Strings(filesNames)
-	//регексп для перевірки назв фалів
-	r, _ := regexp.Compile(db.segmentName + "[0-9]+")
+func (db *Db) nextSegmentName() string {
+	db.segmentNumber++
+	return db.segmentName + strconv.Itoa(db.segmentNumber)
+}
+
+// writeManifest records the current list of blocks as the live segments of the database.
+func (db *Db) writeManifest() error {
+	m := manifest{Format: formatVersion, Segments: make([]string, len(db.blocks)), Indexes: db.Indexes(), Seq: db.seq.Load()}
+	for i, b := range db.blocks {
+		m.Segments[i] = filepath.Base(b.outPath)
+	}
+	return m.write(db.fs, db.dir)
+}
+
+// removeOrphans deletes segments missing from the manifest and other leftovers of interrupted merges.
+// Files which don't belong to the database are left untouched.
+func (db *Db) removeOrphans() error {
+	filesNames, err := db.fs.ReadDirNames(db.dir)
+	if err != nil {
+		return err
+	}
+	live := make(map[string]bool)
+	for _, b := range db.blocks {
+		live[filepath.Base(b.outPath)] = true
+	}
 	for _, fileName := range filesNames {
-		match := r.MatchString(fileName)
+		if live[fileName] || !(strings.HasPrefix(fileName, db.segmentName) || fileName == manifestTempFileName) {
+			continue
+		}
+		if err := db.fs.Remove(filepath.Join(db.dir, fileName)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		if match {
-			b, err := newBlock(db.dir, fileName)
-			if err != nil {
-				return err
-			}
-			db.blocks = append(db.blocks, b)
-			reg, _ := regexp.Compile("[0-9]+")
-			db.segmentNumber, err = strconv.Atoi(reg.FindString(fileName))
-			if err != nil {
-				return err
+func (db *Db) recover(filesNames []string) error {
+	m, err := readManifest(db.fs, db.dir)
+	if err != nil {
+		return err
+	}
+	if m != nil {
+		db.seq.Store(m.Seq)
+	}
+	for i, fileName := range filesNames {
+		open := newBlock
+		if db.readOnly {
+			open = newReadOnlyBlock
+		}
+		b, err := open(db.fs, db.dir, fileName)
+		if errors.Is(err, errTorn) && i == len(filesNames)-1 {
+			if db.readOnly {
+				// The writer of the database can be in the middle of a record, which isn't touched
+				b, err = newReadOnlyTailBlock(db.fs, db.dir, fileName)
+			} else {
+				// A crash in the middle of a write leaves a part of its record at the end of the active segment.
+				// The write was never acknowledged, so the part is dropped.
+				err = cutTornTail(db.fs, filepath.Join(db.dir, fileName))
+				if err == nil {
+					b, err = open(db.fs, db.dir, fileName)
+				}
 			}
-		} else {
-			return fmt.Errorf("wrongly named file in the working directory: %v. Current file neme pattern: %v + int number", fileName, db.segmentName)
+		}
+		if err != nil {
+			return err
+		}
+		b.seq = &db.seq
+		b.onWrite = db.index
+		b.syncWrites = db.syncWrites
+		db.blocks = append(db.blocks, b)
+		if b.lastSeq > db.seq.Load() {
+			db.seq.Store(b.lastSeq)
+		}
+		if n := segmentNumber(fileName); n > db.segmentNumber {
+			db.segmentNumber = n
 		}
 	}
 	return nil
 }
 
 func (db *Db) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+	if db.stopSync != nil {
+		close(db.stopSync)
+	}
+	// Waiters find the database closed
+	db.notifyAll()
 	for _, block := range db.blocks {
 		block.close()
 	}
+	db.blocks = nil
+	if db.lock != nil {
+		err := db.lock.Close()
+		db.lock = nil
+		return err
+	}
 	return nil
 }
 
 func (db *Db) getType(key string) (string, string, error) {
-	var val, vType string
-	var err error
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return "", "", ErrClosed
+	}
+	return db.value(key)
+}
+
+// value returns the latest value of the key. The caller holds db.mu.
+func (db *Db) value(key string) (string, string, error) {
 	for j := len(db.blocks) - 1; j >= 0; j = j - 1 {
-		val, vType, err = db.blocks[j].get(key)
-		if err != nil && err != ErrNotFound {
-			return "", "", err
+		val, vType, err := db.blocks[j].get(key)
+		if err == ErrNotFound {
+			continue
 		}
-		if val != "" {
-			return val, vType, nil
+		if vType == "tombstone" {
+			return "", "", ErrNotFound
 		}
+		return val, vType, err
 	}
-	return "", "", err
+	return "", "", ErrNotFound
 }
 
-func (db *Db) putType(key, vType, value string) error {
-	actBlock := db.blocks[len(db.blocks)-1]
-	curSize, err := actBlock.size()
-	if err != nil {
+// lookup is getType which stops waiting for the disk when ctx is done.
+func (db *Db) lookup(ctx context.Context, key string) (string, string, error) {
+	v, err := db.lookupVersion(ctx, key)
+	return v.Value, v.Type, err
+}
+
+// lookupVersion returns the current version of the key, giving up when ctx is done.
+func (db *Db) lookupVersion(ctx context.Context, key string) (v Version, err error) {
+	start := time.Now()
+	defer func() {
+		db.observe(OpGet, time.Since(start), err)
+	}()
+	if err := ctx.Err(); err != nil {
+		return Version{}, err
+	}
+	if ctx.Done() == nil {
+		return db.Latest(key)
+	}
+
+	type result struct {
+		v   Version
+		err error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		v, err := db.Latest(key)
+		resultCh <- result{v, err}
+	}()
+	select {
+	case r := <-resultCh:
+		return r.v, r.err
+	case <-ctx.Done():
+		return Version{}, ctx.Err()
+	}
+}
+
+// checkSize makes sure a record with the key and a value of the given size fits the limits.
+func (db *Db) checkSize(key string, size int64) error {
+	if int64(len(key)) > db.maxKeySize {
+		return fmt.Errorf("%w: %d bytes (the limit is %d)", ErrKeyTooLarge, len(key), db.maxKeySize)
+	}
+	if size > db.maxValueSize {
+		return fmt.Errorf("%w: %d bytes (the limit is %d)", ErrValueTooLarge, size, db.maxValueSize)
+	}
+	return nil
+}
+
+func (db *Db) putType(ctx context.Context, key, vType, value string) error {
+	if err := db.checkSize(key, int64(len(value))); err != nil {
 		return err
 	}
-	if curSize <= db.segmentSize {
-		err := actBlock.put(key, vType, value)
+	e := entry{key: key, vType: ToByte(vType), value: value}
+	vl := int64(4 + len(value))
+	switch e.vType {
+	case INT64_TYPE:
+		vl = 8
+	case TOMBSTONE_TYPE:
+		vl = 0
+	}
+	return db.write(ctx, e, encodedSize(key, vl), func(b *block, e entry) (time.Duration, error) {
+		return b.put(ctx, e)
+	})
+}
+
+// write stores the record e of the given encoded size in the active block with put.
+// Writes share the block list with readers and line up in the writer of the active block,
+// where they can be abandoned through ctx. Only starting a new block takes the list exclusively.
+func (db *Db) write(ctx context.Context, e entry, size int64, put func(b *block, e entry) (time.Duration, error)) (err error) {
+	start := time.Now()
+	defer func() {
+		db.observe(OpPut, time.Since(start), err)
+	}()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		db.mu.RLock()
+		if err := db.checkWritable(); err != nil {
+			db.mu.RUnlock()
+			return err
+		}
+		if !db.reserve(size) {
+			db.mu.RUnlock()
+			if err := db.makeRoom(size); err != nil {
+				return err
+			}
+			continue
+		}
+		actBlock := db.blocks[len(db.blocks)-1]
+		curSize, err := actBlock.size()
 		if err != nil {
+			db.release(size)
+			db.mu.RUnlock()
+			return err
+		}
+		if curSize <= db.segmentSize {
+			queued, err := put(actBlock, e)
+			// Released under the read lock, so makeRoom doesn't count the space of finished writes twice
+			db.release(size)
+			db.mu.RUnlock()
+			var queueErr error
+			if err != nil && err == ctx.Err() {
+				queueErr = err
+			}
+			db.observe(OpQueue, queued, queueErr)
+			if err == nil {
+				db.notify(e.key)
+			}
+			return err
+		}
+		db.release(size)
+		db.mu.RUnlock()
+
+		if err := db.rollover(actBlock); err != nil {
 			return err
 		}
-		return err
 	}
+}
 
-	//якщо нема вже куди писати, то створюємо новий блок
-	err = db.addNewBlockToDb()
-	if err != nil {
+// rollover starts a new active block after the full one and merges older blocks if there are enough of them.
+func (db *Db) rollover(full *block) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.checkWritable(); err != nil {
 		return err
 	}
-	err = db.blocks[len(db.blocks)-1].put(key, vType, value)
+	if db.blocks[len(db.blocks)-1] != full {
+		// Another write has already done it
+		return nil
+	}
+
+	if db.syncInterval > 0 {
+		// The periodic sync only covers the active segment
+		if err := full.sync(); err != nil {
+			return err
+		}
+	}
+
+	//якщо нема вже куди писати, то створюємо новий блок
+	err := db.addNewBlockToDb()
 	if err != nil {
 		return err
 	}
 
 	//запускаємо мердж, якщо достатньо файлів
-	if len(db.blocks) > 2 {
-		err = db.merge()
-		if err != nil {
+	if db.mergeThreshold > 0 && len(db.blocks)-1 >= db.mergeThreshold {
+		return db.merge()
+	}
+	return nil
+}
+
+// syncPeriodically syncs the active segment every syncInterval until stop is closed.
+func (db *Db) syncPeriodically(stop <-chan struct{}) {
+	ticker := time.NewTicker(db.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		db.mu.RLock()
+		if !db.closed {
+			start := time.Now()
+			err := db.blocks[len(db.blocks)-1].sync()
+			db.observe(OpSync, time.Since(start), err)
+		}
+		db.mu.RUnlock()
+	}
+}
+
+// diskSize returns the total size of segments.
+func (db *Db) diskSize() int64 {
+	var size int64
+	for _, b := range db.blocks {
+		b.mu.RLock()
+		size += b.outOffset
+		b.mu.RUnlock()
+	}
+	return size
+}
+
+// reserve takes the space of a record from the quota, unless it doesn't fit.
+// Concurrent writers can't pass the check together without their records fitting.
+func (db *Db) reserve(size int64) bool {
+	if db.maxDiskSize <= 0 {
+		return true
+	}
+	db.quotaMu.Lock()
+	defer db.quotaMu.Unlock()
+	if db.diskSize()+db.reserved+size > db.maxDiskSize {
+		return false
+	}
+	db.reserved += size
+	return true
+}
+
+// release returns the space reserved for a record once it is written or failed.
+func (db *Db) release(size int64) {
+	if db.maxDiskSize <= 0 {
+		return
+	}
+	db.quotaMu.Lock()
+	defer db.quotaMu.Unlock()
+	db.reserved -= size
+}
+
+// makeRoom compacts the database if a record of the given size doesn't fit the quota.
+// Compaction is skipped when nothing was written since the previous one, as it wouldn't free anything.
+func (db *Db) makeRoom(size int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	used := db.diskSize()
+	if used+size <= db.maxDiskSize {
+		return nil
+	}
+	if used > db.compactedSize {
+		if err := db.compact(); err != nil {
 			return err
 		}
+		db.compactedSize = db.diskSize()
+		if db.compactedSize+size <= db.maxDiskSize {
+			return nil
+		}
+		used = db.compactedSize
 	}
-	return nil
+	return fmt.Errorf("%w: %d of %d bytes are used, the record needs %d", ErrQuotaExceeded, used, db.maxDiskSize, size)
+}
+
+// Lookup returns the value stored by key together with its type.
+func (db *Db) Lookup(key string) (string, string, error) {
+	return db.lookup(context.Background(), key)
+}
+
+// LookupContext is Lookup which gives up when ctx is done.
+func (db *Db) LookupContext(ctx context.Context, key string) (string, string, error) {
+	return db.lookup(ctx, key)
 }
 
 func (db *Db) Get(key string) (string, error) {
-	val, vType, err := db.getType(key)
+	return db.GetContext(context.Background(), key)
+}
+
+// GetContext is Get which gives up when ctx is done.
+func (db *Db) GetContext(ctx context.Context, key string) (string, error) {
+	val, vType, err := db.lookup(ctx, key)
 	if err != nil {
 		return "", err
 	}
 	if vType != "string" {
-		return "", fmt.Errorf("wrong type of value")
+		return "", &WrongTypeError{"string", vType}
 	}
 	return val, nil
 }
 
 func (db *Db) Put(key, value string) error {
-	err := db.putType(key, "string", value)
-	if err != nil {
-		return err
-	}
-	return nil
+	return db.PutContext(context.Background(), key, value)
+}
+
+// PutContext is Put which gives up when ctx is done before the value is handed over to the writer.
+func (db *Db) PutContext(ctx context.Context, key, value string) error {
+	return db.putType(ctx, key, "string", value)
 }
 
 func (db *Db) GetInt64(key string) (int64, error) {
-	val, vType, err := db.getType(key)
+	return db.GetInt64Context(context.Background(), key)
+}
+
+// GetInt64Context is GetInt64 which gives up when ctx is done.
+func (db *Db) GetInt64Context(ctx context.Context, key string) (int64, error) {
+	val, vType, err := db.lookup(ctx, key)
 	if err != nil {
 		return 0, err
 	}
 	if vType != "int64" {
-		return 0, fmt.Errorf("wrong type of value")
+		return 0, &WrongTypeError{"int64", vType}
 	}
 	n, err := strconv.ParseInt(val, 10, 64)
 	if err != nil {
@@ -190,37 +581,387 @@ func (db *Db) GetInt64(key string) (int64, error) {
 }
 
 func (db *Db) PutInt64(key string, value int64) error {
-	err := db.putType(key, "int64", strconv.FormatInt(value, 10))
-	if err != nil {
+	return db.PutInt64Context(context.Background(), key, value)
+}
+
+// PutInt64Context is PutInt64 which gives up when ctx is done before the value is handed over to the writer.
+func (db *Db) PutInt64Context(ctx context.Context, key string, value int64) error {
+	return db.putType(ctx, key, "int64", strconv.FormatInt(value, 10))
+}
+
+// Delete removes the key, or returns ErrNotFound if there is no such key.
+// Old versions of the key stay in its History until merges drop them.
+func (db *Db) Delete(key string) error {
+	return db.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is Delete which gives up when ctx is done before the deletion is handed over to the writer.
+func (db *Db) DeleteContext(ctx context.Context, key string) error {
+	return db.DeleteIfContext(ctx, key, Condition{})
+}
+
+// Exists tells whether the key has a value.
+func (db *Db) Exists(key string) (bool, error) {
+	return db.exists(key)
+}
+
+// IncrBy atomically adds delta to the int64 value of the key and returns the result.
+// A missing key counts as 0.
+func (db *Db) IncrBy(key string, delta int64) (int64, error) {
+	return db.IncrByContext(context.Background(), key, delta)
+}
+
+// IncrByContext is IncrBy which gives up when ctx is done before the increment is handed over to the writer.
+func (db *Db) IncrByContext(ctx context.Context, key string, delta int64) (int64, error) {
+	var result int64
+	err := db.update(ctx, key, encodedSize(key, 8), func(e *entry) error {
+		var current int64
+		value, vType, err := db.value(key)
+		switch {
+		case err == ErrNotFound:
+		case err != nil:
+			return err
+		case vType != "int64":
+			return &WrongTypeError{"int64", vType}
+		default:
+			if current, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return err
+			}
+		}
+		if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+			return ErrOverflow
+		}
+		result = current + delta
+		e.vType = INT64_TYPE
+		e.value = strconv.FormatInt(result, 10)
+		return nil
+	})
+	return result, err
+}
+
+// update writes a record of the key which prepare fills in from the current state of the database.
+// No other write can happen between the two, so prepare can rely on the current value of the key.
+// size is the largest encoded size of the record, which is checked against the quota.
+func (db *Db) update(ctx context.Context, key string, size int64, prepare func(e *entry) error) error {
+	if err := db.checkSize(key, 0); err != nil {
 		return err
 	}
+	return db.write(ctx, entry{key: key}, size, func(b *block, e entry) (time.Duration, error) {
+		return b.update(ctx, e, prepare)
+	})
+}
+
+// Condition restricts PutIf to a state of the key. The zero Condition always holds.
+type Condition struct {
+	// The key must not have a value
+	Missing bool
+	// The key must have a value
+	Exists bool
+	// If not zero, the current version of the key must have this sequence number
+	Seq uint64
+}
+
+func (c Condition) check(current version, found bool) error {
+	switch {
+	case c.Missing && found:
+		return fmt.Errorf("%w: key exists", ErrConditionFailed)
+	case (c.Exists || c.Seq != 0) && !found:
+		return fmt.Errorf("%w: %w", ErrConditionFailed, ErrNotFound)
+	case c.Seq != 0 && current.seq != c.Seq:
+		return fmt.Errorf("%w: version %d is not the current one", ErrConditionFailed, c.Seq)
+	}
+	return nil
+}
+
+// PutIf stores the string value only if the key meets cond at the moment of the write,
+// and returns the sequence number of the new version.
+func (db *Db) PutIf(key, value string, cond Condition) (uint64, error) {
+	return db.PutIfContext(context.Background(), key, value, cond)
+}
+
+// PutIfContext is PutIf which gives up when ctx is done before the value is handed over to the writer.
+func (db *Db) PutIfContext(ctx context.Context, key, value string, cond Condition) (uint64, error) {
+	return db.putTypeIf(ctx, key, "string", value, cond)
+}
+
+// PutInt64If is PutIf for int64 values.
+func (db *Db) PutInt64If(key string, value int64, cond Condition) (uint64, error) {
+	return db.PutInt64IfContext(context.Background(), key, value, cond)
+}
+
+// PutInt64IfContext is PutInt64If which gives up when ctx is done before the value is handed over to the writer.
+func (db *Db) PutInt64IfContext(ctx context.Context, key string, value int64, cond Condition) (uint64, error) {
+	return db.putTypeIf(ctx, key, "int64", strconv.FormatInt(value, 10), cond)
+}
+
+func (db *Db) putTypeIf(ctx context.Context, key, vType, value string, cond Condition) (uint64, error) {
+	if err := db.checkSize(key, int64(len(value))); err != nil {
+		return 0, err
+	}
+	e := entry{key: key, vType: ToByte(vType), value: value}
+	vl := int64(4 + len(value))
+	if e.vType == INT64_TYPE {
+		vl = 8
+	}
+	var written *entry
+	err := db.update(ctx, key, encodedSize(key, vl), func(w *entry) error {
+		if err := cond.check(db.latest(key)); err != nil {
+			return err
+		}
+		w.vType, w.value = e.vType, e.value
+		written = w
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return written.seq, nil
+}
+
+// DeleteIf deletes the key only if it meets cond at the moment of the deletion.
+func (db *Db) DeleteIf(key string, cond Condition) error {
+	return db.DeleteIfContext(context.Background(), key, cond)
+}
+
+// DeleteIfContext is DeleteIf which gives up when ctx is done before the deletion is handed over to the writer.
+func (db *Db) DeleteIfContext(ctx context.Context, key string, cond Condition) error {
+	return db.update(ctx, key, encodedSize(key, 0), func(e *entry) error {
+		current, found := db.latest(key)
+		if !found {
+			return ErrNotFound
+		}
+		if err := cond.check(current, found); err != nil {
+			return err
+		}
+		e.vType = TOMBSTONE_TYPE
+		return nil
+	})
+}
+
+// exists tells whether the key has a value, without reading it.
+func (db *Db) exists(key string) (bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return false, ErrClosed
+	}
+	_, found := db.latest(key)
+	return found, nil
+}
+
+// latest returns the current version of the key. A deleted key has none.
+// The caller holds db.mu or runs in the writer.
+func (db *Db) latest(key string) (version, bool) {
+	for j := len(db.blocks) - 1; j >= 0; j = j - 1 {
+		if vs := db.blocks[j].versions(key); len(vs) > 0 {
+			v := vs[len(vs)-1]
+			return v, !v.tombstone
+		}
+	}
+	return version{}, false
+}
+
+// Version is a single value a key has had.
+type Version struct {
+	Seq       uint64
+	Timestamp time.Time
+	Type      string
+	Value     string
+}
+
+// History returns all retained versions of the key, oldest first.
+func (db *Db) History(key string) ([]Version, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	var history []Version
+	for _, b := range db.blocks {
+		for _, v := range b.versions(key) {
+			pair, err := b.read(v.offset)
+			if err != nil {
+				return nil, err
+			}
+			history = append(history, Version{v.seq, time.Unix(0, v.timestamp), pair.vType, pair.value})
+		}
+	}
+	if len(history) == 0 {
+		return nil, ErrNotFound
+	}
+	return history, nil
+}
+
+// LatestContext is Latest which gives up when ctx is done.
+func (db *Db) LatestContext(ctx context.Context, key string) (Version, error) {
+	return db.lookupVersion(ctx, key)
+}
+
+// Latest returns the current version of the key.
+func (db *Db) Latest(key string) (Version, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return Version{}, ErrClosed
+	}
+	for j := len(db.blocks) - 1; j >= 0; j = j - 1 {
+		vs := db.blocks[j].versions(key)
+		if len(vs) == 0 {
+			continue
+		}
+		v := vs[len(vs)-1]
+		if v.tombstone {
+			break
+		}
+		pair, err := db.blocks[j].read(v.offset)
+		if err != nil {
+			return Version{}, err
+		}
+		return Version{v.seq, time.Unix(0, v.timestamp), pair.vType, pair.value}, nil
+	}
+	return Version{}, ErrNotFound
+}
+
+// GetVersion returns the version of the key written with the given sequence number.
+// Versions dropped by a merge can't be read anymore.
+func (db *Db) GetVersion(key string, seq uint64) (Version, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return Version{}, ErrClosed
+	}
+	for _, b := range db.blocks {
+		for _, v := range b.versions(key) {
+			if v.seq != seq {
+				continue
+			}
+			pair, err := b.read(v.offset)
+			if err != nil {
+				return Version{}, err
+			}
+			return Version{v.seq, time.Unix(0, v.timestamp), pair.vType, pair.value}, nil
+		}
+	}
+	return Version{}, ErrNotFound
+}
+
+func (db *Db) checkWritable() error {
+	if db.closed {
+		return ErrClosed
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
 	return nil
 }
 
 func (db *Db) merge() error {
-	tempBlock, err := mergeAll(db.blocks[:len(db.blocks)-1])
+	return db.mergeFirst(len(db.blocks) - 1)
+}
+
+// Compact merges all segments, including the active one, into a single segment
+// and starts a new active segment after it.
+func (db *Db) Compact() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	return db.compact()
+}
+
+func (db *Db) compact() error {
+	err := db.mergeFirst(len(db.blocks))
+	if err != nil {
+		return err
+	}
+	return db.addNewBlockToDb()
+}
+
+// mergeFirst replaces the n oldest blocks with a single merged block.
+// The merged segment becomes live only when the manifest is updated,
+// so a crash at any moment leaves either the old or the new set of segments.
+func (db *Db) mergeFirst(n int) error {
+	start := time.Now()
+	merged, err := mergeAll(db.fs, db.dir, db.nextSegmentName(), db.blocks[:n], db.retention)
+	db.observe(OpMerge, time.Since(start), err)
 	if err != nil {
 		return err
 	}
+	merged.seq = &db.seq
+	err = merged.sync()
+	if err != nil {
+		merged.delete()
+		return err
+	}
 
-	//додаємо блок до масиву блоків
-	db.blocks = append(db.blocks[:1], db.blocks[:]...)
-	db.blocks[0] = tempBlock
+	old := db.blocks[:n:n]
+	db.blocks = append([]*block{merged}, db.blocks[n:]...)
+	err = db.writeManifest()
+	if err != nil {
+		db.blocks = append(old, db.blocks[1:]...)
+		merged.delete()
+		return err
+	}
 
 	//видаляємо вже непотрібні блоки
-	for _, block := range db.blocks[1 : len(db.blocks)-1] {
-		err := block.delete()
+	for _, block := range old {
+		if delErr := block.delete(); delErr != nil && err == nil {
+			err = delErr
+		}
+	}
+	return err
+}
+
+// Stats describes the current state of the database.
+type Stats struct {
+	Segments int   `json:"segments"`
+	Size     int64 `json:"size"`
+	Keys     int   `json:"keys"`
+}
+
+func (db *Db) Stats() (Stats, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return Stats{}, ErrClosed
+	}
+	stats := Stats{Segments: len(db.blocks)}
+	for _, b := range db.blocks {
+		size, err := b.size()
 		if err != nil {
-			return err
+			return Stats{}, err
 		}
+		stats.Size += size
 	}
+	stats.Keys = len(db.keys())
+	return stats, nil
+}
 
-	//видалимо рештки з масиву
-	db.blocks = append(db.blocks[:1], db.blocks[len(db.blocks)-1])
-	err = os.Rename(tempBlock.segment.Name(), filepath.Join(db.dir, db.segmentName+"0"))
-	tempBlock.outPath = tempBlock.segment.Name()
-	if err != nil {
-		return err
+// Keys returns all stored keys in ascending order.
+func (db *Db) Keys() []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	keys := make([]string, 0)
+	for key := range db.keys() {
+		keys = append(keys, key)
 	}
-	return nil
+	sort.Strings(keys)
+	return keys
+}
+
+func (db *Db) keys() map[string]struct{} {
+	keys := make(map[string]struct{})
+	for _, b := range db.blocks {
+		b.mu.RLock()
+		for key, vs := range b.index {
+			if vs[len(vs)-1].tombstone {
+				delete(keys, key)
+			} else {
+				keys[key] = struct{}{}
+			}
+		}
+		b.mu.RUnlock()
+	}
+	return keys
 }
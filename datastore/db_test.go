@@ -1,11 +1,19 @@
 package datastore
 
 import (
+	"context"
+	"errors"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestDb_Put(t *testing.T) {
@@ -72,6 +80,7 @@ func TestDb_Put(t *testing.T) {
 	})
 
 	t.Run("new db process", func(t *testing.T) {
+		db.Close()
 		db, err = NewDb(dir)
 		if err != nil {
 			t.Fatal(err)
@@ -105,18 +114,13 @@ func TestDb_Put(t *testing.T) {
 			}
 		}
 
-		f, err := os.Open(dir)
-		if err != nil {
-			t.Fatalf("unexpected error: %v", err)
-		}
-		defer f.Close()
-		filesNames, err := f.Readdirnames(0)
+		filesNames, err := listSegments(OS, dir)
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
 		n := len(filesNames)
 		if n != 2 {
-			t.Errorf("Expected 2 files in the directory, got %v", n)
+			t.Errorf("Expected 2 segment files in the directory, got %v", n)
 		}
 	})
 
@@ -152,18 +156,13 @@ func TestDb_Put(t *testing.T) {
 			}
 		}
 
-		f, err := os.Open(dir)
-		if err != nil {
-			t.Fatalf("unexpected error: %v", err)
-		}
-		defer f.Close()
-		filesNames, err := f.Readdirnames(0)
+		filesNames, err := listSegments(OS, dir)
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
 		n := len(filesNames)
 		if n != 2 {
-			t.Errorf("Expected 2 files in the directory, got %v", n)
+			t.Errorf("Expected 2 segment files in the directory, got %v", n)
 		}
 	})
 }
@@ -212,3 +211,727 @@ func TestDb_PutInt64(t *testing.T) {
 	})
 
 }
+
+func TestDb_Compact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.segmentSize = 50
+
+	for i := 0; i < 10; i++ {
+		if err := db.Put("key"+strconv.Itoa(i%3), "value"+strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Segments != 2 || stats.Keys != 3 {
+		t.Errorf("Unexpected stats after compaction: %+v", stats)
+	}
+	expected := map[string]string{"key0": "value9", "key1": "value7", "key2": "value8"}
+	for key, value := range expected {
+		got, err := db.Get(key)
+		if err != nil {
+			t.Errorf("Cannot get %s: %s", key, err)
+		}
+		if got != value {
+			t.Errorf("Bad value for %s: expected %s, got %s", key, value, got)
+		}
+	}
+}
+
+func TestDb_History(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, WithMaxVersions(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	for i := 1; i <= 5; i++ {
+		if err := db.Put("key", "value"+strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.PutInt64("other", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := db.History("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 5 {
+		t.Fatalf("Expected 5 versions before merge, got %d", len(history))
+	}
+	for i, v := range history {
+		if v.Seq != uint64(i+1) || v.Value != "value"+strconv.Itoa(i+1) || v.Type != "string" {
+			t.Errorf("Unexpected version %d: %+v", i, v)
+		}
+	}
+
+	t.Run("merge keeps the last versions", func(t *testing.T) {
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		history, err := db.History("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != 3 || history[0].Value != "value3" || history[2].Value != "value5" {
+			t.Errorf("Unexpected history after merge: %+v", history)
+		}
+
+		v, err := db.GetVersion("key", 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Value != "value4" {
+			t.Errorf("Bad version value: %+v", v)
+		}
+		if _, err := db.GetVersion("key", 1); err != ErrNotFound {
+			t.Errorf("Expected dropped version to be missing, got %v", err)
+		}
+	})
+
+	t.Run("sequence survives reopening", func(t *testing.T) {
+		db.Close()
+		db, err = NewDb(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("key", "value6"); err != nil {
+			t.Fatal(err)
+		}
+		history, err := db.History("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if last := history[len(history)-1]; last.Seq != 7 || last.Value != "value6" {
+			t.Errorf("Unexpected last version: %+v", last)
+		}
+	})
+}
+
+func TestRetention_Keep(t *testing.T) {
+	now := time.Now()
+	vs := []located{
+		{version: version{seq: 1, timestamp: now.Add(-3 * time.Hour).UnixNano()}},
+		{version: version{seq: 2, timestamp: now.Add(-2 * time.Hour).UnixNano()}},
+		{version: version{seq: 3, timestamp: now.Add(-time.Minute).UnixNano()}},
+		{version: version{seq: 4, timestamp: now.UnixNano()}},
+	}
+	cases := []struct {
+		r    retention
+		seqs []uint64
+	}{
+		{retention{versions: 1}, []uint64{4}},
+		{retention{versions: 0}, []uint64{4}},
+		{retention{versions: 2}, []uint64{3, 4}},
+		{retention{versions: 1, window: time.Hour}, []uint64{3, 4}},
+		{retention{versions: 3, window: 150 * time.Minute}, []uint64{2, 3, 4}},
+	}
+	for _, c := range cases {
+		var seqs []uint64
+		for _, v := range c.r.keep(vs, now) {
+			seqs = append(seqs, v.seq)
+		}
+		if !reflect.DeepEqual(seqs, c.seqs) {
+			t.Errorf("%+v: expected %v, got %v", c.r, c.seqs, seqs)
+		}
+	}
+}
+
+func TestDb_Lock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.segmentSize = 50
+	if err := db.Put("key", "value1"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("second writer fails", func(t *testing.T) {
+		if _, err := NewDb(dir); !errors.Is(err, ErrLocked) {
+			t.Errorf("Expected ErrLocked, got %v", err)
+		}
+	})
+
+	t.Run("read-only db coexists with the writer", func(t *testing.T) {
+		ro, err := NewDb(dir, ReadOnly())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ro.Close()
+
+		if err := ro.Put("key", "value2"); err != ErrReadOnly {
+			t.Errorf("Expected ErrReadOnly, got %v", err)
+		}
+		// The writer merges and removes the segments the reader has opened
+		for i := 2; i < 10; i++ {
+			if err := db.Put("key", "value"+strconv.Itoa(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		value, err := ro.Get("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != "value1" {
+			t.Errorf("Expected the value the key had on opening, got %s", value)
+		}
+	})
+
+	t.Run("directory is released on close", func(t *testing.T) {
+		db.Close()
+		db, err = NewDb(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := db.Get("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != "value9" {
+			t.Errorf("Bad value returned expected value9, got %s", value)
+		}
+		db.Close()
+	})
+}
+
+func TestDb_Errors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, WithMaxKeySize(8), WithMaxValueSize(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.PutInt64("number", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("text", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("not found", func(t *testing.T) {
+		if _, err := db.Get("missing"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("wrong type", func(t *testing.T) {
+		_, err := db.Get("number")
+		var typeErr *WrongTypeError
+		if !errors.Is(err, ErrWrongType) || !errors.As(err, &typeErr) {
+			t.Fatalf("Expected a WrongTypeError, got %v", err)
+		}
+		if typeErr.Actual != "int64" || typeErr.Expected != "string" {
+			t.Errorf("Unexpected error details: %+v", typeErr)
+		}
+		if _, err := db.GetInt64("text"); !errors.Is(err, ErrWrongType) {
+			t.Errorf("Expected ErrWrongType, got %v", err)
+		}
+	})
+
+	t.Run("size limits", func(t *testing.T) {
+		if err := db.Put("too-long-key", "value"); !errors.Is(err, ErrKeyTooLarge) {
+			t.Errorf("Expected ErrKeyTooLarge, got %v", err)
+		}
+		if err := db.Put("key", "value longer than 16"); !errors.Is(err, ErrValueTooLarge) {
+			t.Errorf("Expected ErrValueTooLarge, got %v", err)
+		}
+		if err := db.PutStream("key", nil, 17); !errors.Is(err, ErrValueTooLarge) {
+			t.Errorf("Expected ErrValueTooLarge, got %v", err)
+		}
+	})
+
+	t.Run("corrupted", func(t *testing.T) {
+		path := db.blocks[len(db.blocks)-1].outPath
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The last byte of the value before the checksum
+		data[len(data)-checksumSize-1] ^= 0xff
+		if err := ioutil.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Get("text"); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("Expected ErrCorrupted, got %v", err)
+		}
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		db.Close()
+		if _, err := db.Get("text"); !errors.Is(err, ErrClosed) {
+			t.Errorf("Expected ErrClosed, got %v", err)
+		}
+		if err := db.Put("text", "value"); !errors.Is(err, ErrClosed) {
+			t.Errorf("Expected ErrClosed, got %v", err)
+		}
+	})
+}
+
+func TestDb_Context(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		mu       sync.Mutex
+		observed = make(map[Op][]error)
+	)
+	db, err := NewDb(dir, WithObserver(func(op Op, d time.Duration, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		observed[op] = append(observed[op], err)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := db.PutContext(ctx, "key", "value"); !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled from PutContext, got %v", err)
+		}
+		if _, err := db.GetContext(ctx, "key"); !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled from GetContext, got %v", err)
+		}
+		if _, err := db.Get("key"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("The abandoned value is stored: %v", err)
+		}
+	})
+
+	t.Run("busy writer", func(t *testing.T) {
+		// Keep the writer busy with a value that is never fully available
+		pr, pw := io.Pipe()
+		b := db.blocks[len(db.blocks)-1]
+		done := make(chan error)
+		go func() {
+			_, err := b.putStream(context.Background(), entry{key: "slow"}, pr, 4)
+			done <- err
+		}()
+		pw.Write([]byte("sl"))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if err := db.PutContext(ctx, "key", "value"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+		}
+
+		pw.Write([]byte("ow"))
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		if value, err := db.GetContext(context.Background(), "slow"); err != nil || value != "slow" {
+			t.Errorf("Bad value returned [%s]: %v", value, err)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		queued := observed[OpQueue]
+		if len(queued) == 0 || !errors.Is(queued[len(queued)-1], context.DeadlineExceeded) {
+			t.Errorf("The abandoned write is not reported: %v", queued)
+		}
+		if len(observed[OpGet]) == 0 {
+			t.Errorf("Reads are not reported")
+		}
+	})
+
+	t.Run("concurrent writes", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if err := db.PutContext(context.Background(), "counter", strconv.Itoa(i)); err != nil {
+					t.Error(err)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		history, err := db.History("counter")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 1; i < len(history); i++ {
+			if history[i].Seq <= history[i-1].Seq {
+				t.Errorf("Versions are out of order: %d after %d", history[i].Seq, history[i-1].Seq)
+			}
+		}
+		value, _ := db.Get("counter")
+		if last := history[len(history)-1]; last.Value != value {
+			t.Errorf("The latest version %s doesn't match the value %s", last.Value, value)
+		}
+	})
+}
+
+func TestDb_Quota(t *testing.T) {
+	const quota = 1000
+	db, err := NewDb("db", WithFS(NewMemFS()), WithMaxDiskSize(quota))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.segmentSize = 200
+
+	// Overwriting the same keys stays under the quota thanks to compaction
+	for i := 0; i < 100; i++ {
+		if err := db.Put("key"+strconv.Itoa(i%3), "value"+strconv.Itoa(i)); err != nil {
+			t.Fatalf("Put %d: %s", i, err)
+		}
+	}
+	if value, err := db.Get("key0"); err != nil || value != "value99" {
+		t.Errorf("Bad value [%s]: %v", value, err)
+	}
+
+	// New keys can't be compacted away
+	var i int
+	for i = 0; i < 100; i++ {
+		err = db.Put("new"+strconv.Itoa(i), "value")
+		if err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("Expected ErrQuotaExceeded, got %v", err)
+	}
+	if size := db.diskSize(); size > quota {
+		t.Errorf("The database takes %d bytes, more than the quota", size)
+	}
+	for j := 0; j < i; j++ {
+		if _, err := db.Get("new" + strconv.Itoa(j)); err != nil {
+			t.Errorf("Lost new%d: %s", j, err)
+		}
+	}
+	if err := db.PutInt64("new0", 1); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected ErrQuotaExceeded, got %v", err)
+	}
+
+	// Concurrent writers don't pass the check together
+	for round := 0; round < 20; round++ {
+		db, err := NewDb("db", WithFS(NewMemFS()), WithMaxDiskSize(quota))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; ; i++ {
+					if err := db.Put("w"+strconv.Itoa(w)+"/"+strconv.Itoa(i), "value"); err != nil {
+						if !errors.Is(err, ErrQuotaExceeded) {
+							t.Error(err)
+						}
+						return
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+		size := db.diskSize()
+		db.Close()
+		if size > quota {
+			t.Fatalf("Concurrent writers took %d bytes, more than the quota", size)
+		}
+	}
+}
+
+func TestDb_Delete(t *testing.T) {
+	fs := NewMemFS()
+	db, err := NewDb("db", WithFS(fs), WithMaxVersions(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"key1", "key2"} {
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("key1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("key1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound deleting a deleted key, got %v", err)
+	}
+	if _, err := db.Get("key1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if keys := db.Keys(); !reflect.DeepEqual(keys, []string{"key2"}) {
+		t.Errorf("Unexpected keys %v", keys)
+	}
+	history, err := db.History("key1")
+	if err != nil || len(history) != 2 || history[1].Type != "tombstone" {
+		t.Errorf("Unexpected history %v: %v", history, err)
+	}
+
+	// The tombstone outlives merges while older versions are kept
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	db, err = NewDb("db", WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Get("key1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound after reopening, got %v", err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.History("key1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the deleted key to be merged away, got %v", err)
+	}
+	if value, err := db.Get("key2"); err != nil || value != "value" {
+		t.Errorf("Bad value [%s]: %v", value, err)
+	}
+
+	// The sequence number of the merged away tombstone isn't given out again
+	db.Close()
+	db, err = NewDb("db", WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("key1", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Latest("key1"); err != nil || v.Seq <= history[1].Seq {
+		t.Errorf("Sequence number %d is reused after the tombstone %d: %v", v.Seq, history[1].Seq, err)
+	}
+
+	// Of concurrent deletions of a key only one finds it
+	for i := 0; i < 100; i++ {
+		if err := db.Put("key3", "value"); err != nil {
+			t.Fatal(err)
+		}
+		var (
+			wg      sync.WaitGroup
+			deleted atomic.Int32
+		)
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := db.Delete("key3")
+				if err == nil {
+					deleted.Add(1)
+				} else if !errors.Is(err, ErrNotFound) {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+		if n := deleted.Load(); n != 1 {
+			t.Fatalf("The key is deleted %d times", n)
+		}
+	}
+}
+
+func TestDb_IncrBy(t *testing.T) {
+	db, err := NewDb("db", WithFS(NewMemFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.segmentSize = 500
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := db.IncrBy("counter", 2); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n, err := db.GetInt64("counter"); err != nil || n != 100 {
+		t.Errorf("Expected 100, got %d: %v", n, err)
+	}
+	if n, err := db.IncrBy("counter", -101); err != nil || n != -1 {
+		t.Errorf("Expected -1, got %d: %v", n, err)
+	}
+
+	if err := db.Put("text", "10"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.IncrBy("text", 1); !errors.Is(err, ErrWrongType) {
+		t.Errorf("Expected ErrWrongType, got %v", err)
+	}
+	if err := db.PutInt64("big", 1<<62); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.IncrBy("big", 1<<62); !errors.Is(err, ErrOverflow) {
+		t.Errorf("Expected ErrOverflow, got %v", err)
+	}
+	if n, err := db.GetInt64("big"); err != nil || n != 1<<62 {
+		t.Errorf("The failed increment changed the value: %d, %v", n, err)
+	}
+}
+
+func TestDb_PutIf(t *testing.T) {
+	db, err := NewDb("db", WithFS(NewMemFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.PutIf("key", "v1", Condition{Exists: true}); !errors.Is(err, ErrConditionFailed) {
+		t.Errorf("Expected ErrConditionFailed for a missing key, got %v", err)
+	}
+	seq, err := db.PutIf("key", "v1", Condition{Missing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.PutIf("key", "v2", Condition{Missing: true}); !errors.Is(err, ErrConditionFailed) {
+		t.Errorf("Expected ErrConditionFailed for an existing key, got %v", err)
+	}
+	if v, err := db.Latest("key"); err != nil || v.Seq != seq || v.Value != "v1" {
+		t.Errorf("Unexpected latest version %+v: %v", v, err)
+	}
+
+	next, err := db.PutIf("key", "v2", Condition{Seq: seq})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next <= seq {
+		t.Errorf("Expected a new sequence number after %d, got %d", seq, next)
+	}
+	if _, err := db.PutIf("key", "v3", Condition{Seq: seq}); !errors.Is(err, ErrConditionFailed) {
+		t.Errorf("Expected ErrConditionFailed for a stale version, got %v", err)
+	}
+	if value, err := db.Get("key"); err != nil || value != "v2" {
+		t.Errorf("Bad value [%s]: %v", value, err)
+	}
+
+	if err := db.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Latest("key"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for a deleted key, got %v", err)
+	}
+	if _, err := db.PutIf("key", "v4", Condition{Missing: true}); err != nil {
+		t.Errorf("Can't add a deleted key: %v", err)
+	}
+}
+
+func TestDb_Sync(t *testing.T) {
+	t.Run("every write", func(t *testing.T) {
+		fs := NewFaultFS(NewMemFS())
+		db, err := NewDb("db", WithFS(fs), WithSyncWrites())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		before := fs.Calls(FileSync)
+		for i := 0; i < 3; i++ {
+			if err := db.Put("key", "value"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n := fs.Calls(FileSync) - before; n != 3 {
+			t.Errorf("Expected 3 syncs, got %d", n)
+		}
+
+		// A write which can't be synced is not acknowledged
+		fs.Inject(Fault{Op: FileSync, Name: "segment-*", Err: syscall.EIO})
+		if err := db.Put("key", "lost"); !errors.Is(err, syscall.EIO) {
+			t.Errorf("Expected EIO, got %v", err)
+		}
+		if value, err := db.Get("key"); err != nil || value != "value" {
+			t.Errorf("Bad value [%s]: %v", value, err)
+		}
+	})
+
+	t.Run("interval", func(t *testing.T) {
+		fs := NewFaultFS(NewMemFS())
+		synced := make(chan error, 10)
+		db, err := NewDb("db", WithFS(fs), WithSyncInterval(time.Millisecond), WithObserver(func(op Op, d time.Duration, err error) {
+			if op == OpSync {
+				select {
+				case synced <- err:
+				default:
+				}
+			}
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("key", "value"); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-synced; err != nil {
+			t.Errorf("Periodic sync failed: %s", err)
+		}
+		db.Close()
+	})
+}
+
+func TestDb_MergeThreshold(t *testing.T) {
+	db, err := NewDb("db", WithFS(NewMemFS()), WithSegmentSize(0), WithMergeThreshold(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 5; i++ {
+		if err := db.Put("key", strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(db.blocks) != 5 {
+		t.Errorf("Expected 5 segments without merges, got %d", len(db.blocks))
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.blocks) != 2 {
+		t.Errorf("Expected the merged and the active segments, got %d", len(db.blocks))
+	}
+}
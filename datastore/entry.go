@@ -4,6 +4,8 @@ import (
 	"bufio"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"strconv"
 )
 
@@ -11,64 +13,84 @@ type entry struct {
 	key   string
 	vType byte
 	value string
+
+	// Sequence number of the write and the time it was made at (in Unix nanoseconds)
+	seq       uint64
+	timestamp int64
 }
 
 type typeOperator interface {
 	Encode(*entry) []byte
 	Decode([]byte, *entry)
-	Read(*bufio.Reader) (string, error)
+	// Len returns the size of the encoded value stored at the beginning of data,
+	// or -1 if data is too short to tell.
+	Len(data []byte) int
 }
 
 type stringOperator struct{}
 
+// encodeKey allocates a record for a value of vl encoded bytes and fills in its header and key.
 func encodeKey(e *entry, vl int) ([]byte, int) {
+	res := make([]byte, headerSize+len(e.key)+TYPE_SIZE+vl+checksumSize)
+	return res, putHeader(res, e, len(res))
+}
+
+// encodedSize returns the size of a record with the key and a value taking vl bytes encoded.
+func encodedSize(key string, vl int64) int64 {
+	return minEntrySize + int64(len(key)) + vl
+}
+
+// putHeader fills in the header and the key of a record of the given size
+// and returns the offset of the value type.
+func putHeader(res []byte, e *entry, size int) int {
 	kl := len(e.key)
-	size := kl + TYPE_SIZE + vl + 12
-	res := make([]byte, size)
 	binary.LittleEndian.PutUint32(res, uint32(size))
 	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
-	copy(res[8:], e.key)
-	return res, kl + 8
+	binary.LittleEndian.PutUint64(res[8:], e.seq)
+	binary.LittleEndian.PutUint64(res[16:], uint64(e.timestamp))
+	copy(res[headerSize:], e.key)
+	return headerSize + kl
+}
+
+// encodeStringHeader returns the part of a string record preceding its value of vl bytes,
+// for values that are written separately. The value has to be followed by the checksum.
+func encodeStringHeader(e *entry, vl int) []byte {
+	res := make([]byte, headerSize+len(e.key)+TYPE_SIZE+4)
+	offset := putHeader(res, e, len(res)+vl+checksumSize)
+	res[offset] = STRING_TYPE
+	binary.LittleEndian.PutUint32(res[offset+TYPE_SIZE:], uint32(vl))
+	return res
+}
+
+// seal writes the checksum of the record into its last bytes.
+func seal(res []byte) []byte {
+	body := len(res) - checksumSize
+	binary.LittleEndian.PutUint32(res[body:], crc32.ChecksumIEEE(res[:body]))
+	return res
 }
 
 func (s stringOperator) Encode(e *entry) []byte {
-	res, offset := encodeKey(e, len(e.value))
 	vl := len(e.value)
+	res, offset := encodeKey(e, vl+4)
 	res[offset] = STRING_TYPE
 	binary.LittleEndian.PutUint32(res[offset+TYPE_SIZE:], uint32(vl))
 	copy(res[offset+TYPE_SIZE+4:], e.value)
-	return res
+	return seal(res)
 }
 
 func (s stringOperator) Decode(input []byte, e *entry) {
 	kl := len(e.key)
-	vl := binary.LittleEndian.Uint32(input[kl+TYPE_SIZE+8:])
+	vl := binary.LittleEndian.Uint32(input[headerSize+kl+TYPE_SIZE:])
 	valBuf := make([]byte, vl)
-	copy(valBuf, input[kl+TYPE_SIZE+12:kl+TYPE_SIZE+12+int(vl)])
+	copy(valBuf, input[headerSize+kl+TYPE_SIZE+4:headerSize+kl+TYPE_SIZE+4+int(vl)])
 	e.value = string(valBuf)
 }
 
-func (s stringOperator) Read(in *bufio.Reader) (string, error) {
-	header, err := in.Peek(4)
-	if err != nil {
-		return "", err
-	}
-	valSize := int(binary.LittleEndian.Uint32(header))
-	_, err = in.Discard(4)
-	if err != nil {
-		return "", err
-	}
-
-	data := make([]byte, valSize)
-	n, err := in.Read(data)
-	if err != nil {
-		return "", err
-	}
-	if n != valSize {
-		return "", fmt.Errorf("can't read value bytes (read %d, expected %d)", n, valSize)
+func (s stringOperator) Len(data []byte) int {
+	if len(data) < 4 {
+		return -1
 	}
-
-	return string(data), nil
+	return 4 + int(binary.LittleEndian.Uint32(data))
 }
 
 type int64Operator struct{}
@@ -81,27 +103,40 @@ func (s int64Operator) Encode(e *entry) []byte {
 	}
 	res[offset] = INT64_TYPE
 	binary.LittleEndian.PutUint64(res[offset+TYPE_SIZE:], uint64(i))
-	return res
+	return seal(res)
 }
 
 func (s int64Operator) Decode(input []byte, e *entry) {
 	kl := len(e.key)
-	value := binary.LittleEndian.Uint64(input[kl+TYPE_SIZE+8 : kl+TYPE_SIZE+16])
+	value := binary.LittleEndian.Uint64(input[headerSize+kl+TYPE_SIZE : headerSize+kl+TYPE_SIZE+8])
 	e.value = fmt.Sprintf("%d", int64(value))
 }
 
-func (s int64Operator) Read(in *bufio.Reader) (string, error) {
-	data, err := in.Peek(8)
-	if err != nil {
-		return "", err
-	}
-	value := binary.LittleEndian.Uint64(data)
-	return fmt.Sprintf("%d", int64(value)), nil
+func (s int64Operator) Len(data []byte) int {
+	return 8
+}
+
+// tombstoneOperator encodes records marking deleted keys, which have no value.
+type tombstoneOperator struct{}
+
+func (s tombstoneOperator) Encode(e *entry) []byte {
+	res, offset := encodeKey(e, 0)
+	res[offset] = TOMBSTONE_TYPE
+	return seal(res)
+}
+
+func (s tombstoneOperator) Decode(input []byte, e *entry) {
+	e.value = ""
+}
+
+func (s tombstoneOperator) Len(data []byte) int {
+	return 0
 }
 
 var typeToByte map[string]byte = map[string]byte{
-	"string": STRING_TYPE,
-	"int64":  INT64_TYPE,
+	"string":    STRING_TYPE,
+	"int64":     INT64_TYPE,
+	"tombstone": TOMBSTONE_TYPE,
 }
 
 func ToByte(vType string) byte {
@@ -118,14 +153,25 @@ func ToType(value byte) string {
 }
 
 var operators map[byte]typeOperator = map[byte]typeOperator{
-	STRING_TYPE: stringOperator{},
-	INT64_TYPE:  int64Operator{},
+	STRING_TYPE:    stringOperator{},
+	INT64_TYPE:     int64Operator{},
+	TOMBSTONE_TYPE: tombstoneOperator{},
 }
 
 const (
 	TYPE_SIZE        = 1
 	STRING_TYPE byte = 0
 	INT64_TYPE  byte = 1
+	// Marks a deleted key
+	TOMBSTONE_TYPE byte = 2
+)
+
+const (
+	// Record size, key length, sequence number and timestamp
+	headerSize   = 24
+	checksumSize = 4
+	// The smallest possible record: header, type and checksum.
+	minEntrySize = headerSize + TYPE_SIZE + checksumSize
 )
 
 func (e *entry) Encode() []byte {
@@ -135,45 +181,69 @@ func (e *entry) Encode() []byte {
 
 func (e *entry) Decode(input []byte) {
 	kl := binary.LittleEndian.Uint32(input[4:])
+	e.seq = binary.LittleEndian.Uint64(input[8:])
+	e.timestamp = int64(binary.LittleEndian.Uint64(input[16:]))
 	keyBuf := make([]byte, kl)
-	copy(keyBuf, input[8:kl+8])
+	copy(keyBuf, input[headerSize:headerSize+kl])
 	e.key = string(keyBuf)
 
-	typeValue := input[kl+8]
-	operator := operators[typeValue]
+	e.vType = input[headerSize+kl]
+	operator := operators[e.vType]
 
 	operator.Decode(input, e)
 }
 
+// validate checks that data holds exactly one well-formed record with a matching checksum.
+func validate(data []byte) error {
+	if len(data) < minEntrySize {
+		return fmt.Errorf("record is too short (%d bytes)", len(data))
+	}
+	size := int(binary.LittleEndian.Uint32(data))
+	if size != len(data) {
+		return fmt.Errorf("record size %d does not match its length %d", size, len(data))
+	}
+	kl := int(binary.LittleEndian.Uint32(data[4:]))
+	if kl > size-minEntrySize {
+		return fmt.Errorf("key length %d exceeds record size %d", kl, size)
+	}
+	operator, ok := operators[data[headerSize+kl]]
+	if !ok {
+		return fmt.Errorf("unknown value type %d", data[headerSize+kl])
+	}
+	value := data[headerSize+kl+TYPE_SIZE : size-checksumSize]
+	if vl := operator.Len(value); vl != len(value) {
+		return fmt.Errorf("value length %d does not match record size %d", vl, size)
+	}
+	sum := binary.LittleEndian.Uint32(data[size-checksumSize:])
+	if sum != crc32.ChecksumIEEE(data[:size-checksumSize]) {
+		return fmt.Errorf("checksum mismatch")
+	}
+	return nil
+}
+
 type output struct {
 	vType string
 	value string
 }
 
+// readValue reads a whole record and returns its value once its checksum is verified.
 func readValue(in *bufio.Reader) (output, error) {
-	header, err := in.Peek(8)
-	if err != nil {
-		return output{}, err
-	}
-	keySize := int(binary.LittleEndian.Uint32(header[4:]))
-	_, err = in.Discard(keySize + 8)
+	header, err := in.Peek(4)
 	if err != nil {
 		return output{}, err
 	}
-
-	vType, err := in.Peek(1)
-	if err != nil {
-		return output{}, err
+	size := binary.LittleEndian.Uint32(header)
+	if size < minEntrySize {
+		return output{}, fmt.Errorf("%w: record is too short (%d bytes)", ErrCorrupted, size)
 	}
-	_, err = in.Discard(1)
-	if err != nil {
-		return output{}, err
+	data := make([]byte, size)
+	if _, err := io.ReadFull(in, data); err != nil {
+		return output{}, fmt.Errorf("%w: can't read record: %s", ErrCorrupted, err)
 	}
-
-	operator := operators[vType[0]]
-	data, err := operator.Read(in)
-	if err != nil {
-		return output{}, err
+	if err := validate(data); err != nil {
+		return output{}, fmt.Errorf("%w: %s", ErrCorrupted, err)
 	}
-	return output{ToType(vType[0]), data}, nil
+	var e entry
+	e.Decode(data)
+	return output{ToType(e.vType), e.value}, nil
 }
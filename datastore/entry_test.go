@@ -7,7 +7,7 @@ import (
 )
 
 func TestEntry_Encode(t *testing.T) {
-	e := entry{"key", ToByte("string"), "value"}
+	e := entry{key: "key", vType: ToByte("string"), value: "value"}
 	e.Decode(e.Encode())
 	if e.key != "key" {
 		t.Error("incorrect key")
@@ -18,7 +18,7 @@ func TestEntry_Encode(t *testing.T) {
 }
 
 func TestReadValue(t *testing.T) {
-	e := entry{"key", ToByte("string"), "test-value"}
+	e := entry{key: "key", vType: ToByte("string"), value: "test-value"}
 	data := e.Encode()
 	v, err := readValue(bufio.NewReader(bytes.NewReader(data)))
 	if err != nil {
@@ -33,7 +33,7 @@ func TestReadValue(t *testing.T) {
 }
 
 func TestReadValueInt64(t *testing.T) {
-	e := entry{"key", ToByte("int64"), "-12"}
+	e := entry{key: "key", vType: ToByte("int64"), value: "-12"}
 	data := e.Encode()
 	v, err := readValue(bufio.NewReader(bytes.NewReader(data)))
 	if err != nil {
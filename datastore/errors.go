@@ -0,0 +1,44 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrNotFound      = errors.New("record does not exist")
+	ErrKeyTooLarge   = errors.New("key is too large")
+	ErrValueTooLarge = errors.New("value is too large")
+	ErrClosed        = errors.New("database is closed")
+	// Reported for records whose structure or checksum is broken
+	ErrCorrupted = errors.New("corrupted data")
+	// Matches every *WrongTypeError
+	ErrWrongType = errors.New("wrong type of value")
+
+	ErrLocked      = errors.New("database directory is used by another Db")
+	ErrReadOnly    = errors.New("database is opened in read-only mode")
+	ErrNoIndex     = errors.New("index does not exist")
+	ErrIndexExists = errors.New("index already exists")
+	// Returned when an increment doesn't fit int64
+	ErrOverflow = errors.New("increment or decrement would overflow")
+	// Returned when a write doesn't fit the disk quota even after compaction
+	ErrQuotaExceeded = errors.New("disk quota exceeded")
+	// Returned by PutIf when the key doesn't meet the condition
+	ErrConditionFailed = errors.New("condition failed")
+	// Returned for directories whose format this version can't read
+	ErrUnsupportedFormat = errors.New("unsupported database format")
+)
+
+// WrongTypeError is returned when a value is requested as a type other than the one it was stored with.
+type WrongTypeError struct {
+	Expected string
+	Actual   string
+}
+
+func (e *WrongTypeError) Error() string {
+	return fmt.Sprintf("wrong type of value: expected %s, got %s", e.Expected, e.Actual)
+}
+
+func (e *WrongTypeError) Is(target error) bool {
+	return target == ErrWrongType
+}
@@ -0,0 +1,247 @@
+package datastore
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileOp is an operation of an FS a Fault can be injected into.
+type FileOp string
+
+const (
+	// OpenFile and CreateTemp
+	FileOpen  FileOp = "open"
+	FileWrite FileOp = "write"
+	// File.Sync and FS.SyncDir
+	FileSync     FileOp = "sync"
+	FileTruncate FileOp = "truncate"
+	FileRename   FileOp = "rename"
+	FileRemove   FileOp = "remove"
+)
+
+// ErrCrashed is returned by a FaultFS for every call after a simulated crash.
+var ErrCrashed = errors.New("simulated crash")
+
+var errInjected = errors.New("injected fault")
+
+// Fault is a failure injected into a single call of a FaultFS.
+type Fault struct {
+	Op FileOp
+	// Pattern matched against the base name of the file with filepath.Match. An empty one matches any file
+	Name string
+	// The number of matching calls that succeed before the failing one
+	After int
+	// The error of the failing call, such as syscall.ENOSPC
+	Err error
+	// The number of bytes a failing write still writes, simulating a short write
+	Short int
+	// Crash stops the file system at the failing call: it fails with ErrCrashed, and so do all calls after it
+	Crash bool
+}
+
+// FaultFS wraps another FS and makes chosen calls fail.
+// Together with MemFS.CrashImage it shows what a Db finds after a crash at any point.
+type FaultFS struct {
+	fs FS
+
+	mu      sync.Mutex
+	faults  []*Fault
+	calls   map[FileOp]int
+	crashed bool
+}
+
+func NewFaultFS(fs FS) *FaultFS {
+	return &FaultFS{fs: fs, calls: make(map[FileOp]int)}
+}
+
+// Inject adds faults. Each of them fails a single call.
+func (f *FaultFS) Inject(faults ...Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range faults {
+		fault := faults[i]
+		f.faults = append(f.faults, &fault)
+	}
+}
+
+// Calls returns the number of calls of op made so far, so a test can first count the calls of a scenario
+// and then run it again failing each of them in turn.
+func (f *FaultFS) Calls(op FileOp) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[op]
+}
+
+// Crashed tells whether a crash has been simulated.
+func (f *FaultFS) Crashed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.crashed
+}
+
+// check counts a call of op on the named file and returns the fault it has to fail with, if any.
+func (f *FaultFS) check(op FileOp, name string) (*Fault, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.crashed {
+		return nil, ErrCrashed
+	}
+	f.calls[op]++
+	for i, fault := range f.faults {
+		if fault.Op != op {
+			continue
+		}
+		if fault.Name != "" {
+			if ok, _ := filepath.Match(fault.Name, filepath.Base(name)); !ok {
+				continue
+			}
+		}
+		if fault.After > 0 {
+			fault.After--
+			continue
+		}
+		f.faults = append(f.faults[:i], f.faults[i+1:]...)
+		if fault.Crash {
+			f.crashed = true
+			return fault, ErrCrashed
+		}
+		if fault.Err != nil {
+			return fault, fault.Err
+		}
+		return fault, errInjected
+	}
+	return nil, nil
+}
+
+// alive fails calls that are not subject to faults after a crash.
+func (f *FaultFS) alive() error {
+	if f.Crashed() {
+		return ErrCrashed
+	}
+	return nil
+}
+
+func (f *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if _, err := f.check(FileOpen, name); err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	file, err := f.fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{file, f}, nil
+}
+
+func (f *FaultFS) CreateTemp(dir, pattern string) (File, error) {
+	if _, err := f.check(FileOpen, filepath.Join(dir, pattern)); err != nil {
+		return nil, &os.PathError{Op: "createtemp", Path: filepath.Join(dir, pattern), Err: err}
+	}
+	file, err := f.fs.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{file, f}, nil
+}
+
+func (f *FaultFS) Stat(name string) (os.FileInfo, error) {
+	if err := f.alive(); err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return f.fs.Stat(name)
+}
+
+func (f *FaultFS) Remove(name string) error {
+	if _, err := f.check(FileRemove, name); err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+	return f.fs.Remove(name)
+}
+
+func (f *FaultFS) Rename(oldpath, newpath string) error {
+	if _, err := f.check(FileRename, newpath); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	return f.fs.Rename(oldpath, newpath)
+}
+
+func (f *FaultFS) MkdirAll(path string, perm os.FileMode) error {
+	if err := f.alive(); err != nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+	return f.fs.MkdirAll(path, perm)
+}
+
+func (f *FaultFS) ReadDirNames(dir string) ([]string, error) {
+	if err := f.alive(); err != nil {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: err}
+	}
+	return f.fs.ReadDirNames(dir)
+}
+
+func (f *FaultFS) SyncDir(dir string) error {
+	if _, err := f.check(FileSync, dir); err != nil {
+		return &os.PathError{Op: "sync", Path: dir, Err: err}
+	}
+	return f.fs.SyncDir(dir)
+}
+
+func (f *FaultFS) Lock(name string) (io.Closer, error) {
+	if err := f.alive(); err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return f.fs.Lock(name)
+}
+
+// faultFile injects the faults of its FaultFS into the calls of a file.
+// It can still be closed after a crash, so the resources of the wrapped file are released.
+type faultFile struct {
+	File
+	fs *FaultFS
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	if err := f.fs.alive(); err != nil {
+		return 0, &os.PathError{Op: "read", Path: f.Name(), Err: err}
+	}
+	return f.File.Read(p)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.fs.alive(); err != nil {
+		return 0, &os.PathError{Op: "read", Path: f.Name(), Err: err}
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	fault, err := f.fs.check(FileWrite, f.Name())
+	if err == nil {
+		return f.File.Write(p)
+	}
+	n := 0
+	if fault != nil && fault.Short > 0 {
+		short := p
+		if fault.Short < len(p) {
+			short = p[:fault.Short]
+		}
+		n, _ = f.File.Write(short)
+	}
+	return n, &os.PathError{Op: "write", Path: f.Name(), Err: err}
+}
+
+func (f *faultFile) Sync() error {
+	if _, err := f.fs.check(FileSync, f.Name()); err != nil {
+		return &os.PathError{Op: "sync", Path: f.Name(), Err: err}
+	}
+	return f.File.Sync()
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if _, err := f.fs.check(FileTruncate, f.Name()); err != nil {
+		return &os.PathError{Op: "truncate", Path: f.Name(), Err: err}
+	}
+	return f.File.Truncate(size)
+}
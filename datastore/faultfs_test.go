@@ -0,0 +1,269 @@
+package datastore
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestMemFS(t *testing.T) {
+	fs := NewMemFS()
+	if err := fs.MkdirAll("db", 0o700); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.OpenFile("db/file", os.O_APPEND|os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("synced"))
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(" lost"))
+
+	if err := fs.Rename("db/file", "db/renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := fs.ReadDirNames("db"); err != nil || len(names) != 1 || names[0] != "renamed" {
+		t.Errorf("Unexpected directory entries %v: %v", names, err)
+	}
+	data, err := readFile(fs, "db/renamed")
+	if err != nil || string(data) != "synced lost" {
+		t.Errorf("Bad content [%s]: %v", data, err)
+	}
+	data, err = readFile(fs.CrashImage(), "db/renamed")
+	if err != nil || string(data) != "synced" {
+		t.Errorf("Bad content after a crash [%s]: %v", data, err)
+	}
+
+	// A removed file stays readable through the open descriptor
+	if err := fs.Remove("db/renamed"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 6)
+	if _, err := f.ReadAt(buf, 0); err != nil || string(buf) != "synced" {
+		t.Errorf("Bad content of the removed file [%s]: %v", buf, err)
+	}
+	if _, err := fs.Stat("db/renamed"); !os.IsNotExist(err) {
+		t.Errorf("Expected the file to be removed, got %v", err)
+	}
+	f.Close()
+}
+
+func TestDb_Faults(t *testing.T) {
+	t.Run("short write", func(t *testing.T) {
+		mem := NewMemFS()
+		fs := NewFaultFS(mem)
+		db, err := NewDb("db", WithFS(fs))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("key1", "value1"); err != nil {
+			t.Fatal(err)
+		}
+		fs.Inject(Fault{Op: FileWrite, Name: "segment-*", Err: syscall.ENOSPC, Short: 5})
+		if err := db.Put("key2", "value2"); !errors.Is(err, syscall.ENOSPC) {
+			t.Errorf("Expected ENOSPC, got %v", err)
+		}
+		if err := db.Put("key3", "value3"); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+
+		// The partial record is cut off, so the segment is still readable
+		db, err = NewDb("db", WithFS(mem))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		for key, expected := range map[string]string{"key1": "value1", "key3": "value3"} {
+			if value, err := db.Get(key); err != nil || value != expected {
+				t.Errorf("Bad value of %s [%s]: %v", key, value, err)
+			}
+		}
+		if _, err := db.Get("key2"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected the failed write to be lost, got %v", err)
+		}
+	})
+
+	t.Run("merge sync failure", func(t *testing.T) {
+		mem := NewMemFS()
+		fs := NewFaultFS(mem)
+		db, err := NewDb("db", WithFS(fs))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if err := db.Put("key", "value1"); err != nil {
+			t.Fatal(err)
+		}
+		fs.Inject(Fault{Op: FileSync, Name: "segment-*", Err: syscall.EIO})
+		if err := db.Compact(); !errors.Is(err, syscall.EIO) {
+			t.Errorf("Expected EIO, got %v", err)
+		}
+		if value, err := db.Get("key"); err != nil || value != "value1" {
+			t.Errorf("Bad value after the failed merge [%s]: %v", value, err)
+		}
+		if err := db.Put("key", "value2"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		if value, err := db.Get("key"); err != nil || value != "value2" {
+			t.Errorf("Bad value after the merge [%s]: %v", value, err)
+		}
+	})
+
+	t.Run("torn tail", func(t *testing.T) {
+		mem := NewMemFS()
+		db, err := NewDb("db", WithFS(mem))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("key", "value"); err != nil {
+			t.Fatal(err)
+		}
+		path := db.blocks[len(db.blocks)-1].outPath
+		db.Close()
+		size := appendTo(t, mem, path, (&entry{key: "torn", value: "value", seq: 2}).Encode()[:10])
+
+		db, err = NewDb("db", WithFS(mem))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if value, err := db.Get("key"); err != nil || value != "value" {
+			t.Errorf("Bad value [%s]: %v", value, err)
+		}
+		if info, err := mem.Stat(path); err != nil || info.Size() != size {
+			t.Errorf("Expected the torn record to be cut off: %v", err)
+		}
+	})
+
+	t.Run("torn tail in read-only mode", func(t *testing.T) {
+		mem := NewMemFS()
+		db, err := NewDb("db", WithFS(mem))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if err := db.Put("key", "value"); err != nil {
+			t.Fatal(err)
+		}
+		// The writer is in the middle of a record
+		path := db.blocks[len(db.blocks)-1].outPath
+		appendTo(t, mem, path, (&entry{key: "torn", value: "value", seq: 2}).Encode()[:10])
+		info, err := mem.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ro, err := NewDb("db", WithFS(mem), ReadOnly())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ro.Close()
+		if value, err := ro.Get("key"); err != nil || value != "value" {
+			t.Errorf("Bad value [%s]: %v", value, err)
+		}
+		if _, err := ro.Get("torn"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound for the torn record, got %v", err)
+		}
+		if after, err := mem.Stat(path); err != nil || after.Size() != info.Size() {
+			t.Errorf("Expected the segment to be left as it is: %v", err)
+		}
+	})
+}
+
+// appendTo appends data to the file and returns its size before that.
+func appendTo(t *testing.T, fs FS, path string, data []byte) int64 {
+	f, err := fs.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+// writeScenario fills a new Db rolling over to a new segment on every write, compacts it and writes some more.
+// It stops at the first error and returns the values which were made durable by the compaction by then.
+func writeScenario(fs FS) (map[string]string, error) {
+	db, err := NewDb("db", WithFS(fs))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	db.segmentSize = 0
+
+	values := make(map[string]string)
+	for i := 0; i < 12; i++ {
+		key, value := "key"+strconv.Itoa(i%4), "value"+strconv.Itoa(i)
+		if err := db.Put(key, value); err != nil {
+			return nil, err
+		}
+		values[key] = value
+	}
+	if err := db.Compact(); err != nil {
+		return nil, err
+	}
+	for i := 12; i < 16; i++ {
+		if err := db.Put("key"+strconv.Itoa(i%4), "value"+strconv.Itoa(i)); err != nil {
+			return values, err
+		}
+	}
+	return values, nil
+}
+
+func TestDb_Crash(t *testing.T) {
+	dry := NewFaultFS(NewMemFS())
+	if _, err := writeScenario(dry); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, op := range []FileOp{FileOpen, FileWrite, FileSync, FileTruncate, FileRename, FileRemove} {
+		for n := 0; n < dry.Calls(op); n++ {
+			mem := NewMemFS()
+			fs := NewFaultFS(mem)
+			fs.Inject(Fault{Op: op, After: n, Short: 7, Crash: true})
+			durable, err := writeScenario(fs)
+			if !errors.Is(err, ErrCrashed) {
+				t.Fatalf("%s #%d: expected a crash, got %v", op, n, err)
+			}
+
+			db, err := NewDb("db", WithFS(mem.CrashImage()))
+			if err != nil {
+				t.Fatalf("%s #%d: can't recover: %s", op, n, err)
+			}
+			for i := 0; i < 4; i++ {
+				key := "key" + strconv.Itoa(i)
+				value, err := db.Get(key)
+				if errors.Is(err, ErrNotFound) && durable[key] == "" {
+					continue
+				}
+				if err != nil {
+					t.Errorf("%s #%d: can't read %s: %s", op, n, key, err)
+					continue
+				}
+				written, err := strconv.Atoi(strings.TrimPrefix(value, "value"))
+				if err != nil || written%4 != i {
+					t.Errorf("%s #%d: %s has a value never written to it: %s", op, n, key, value)
+				}
+				if compacted, err := strconv.Atoi(strings.TrimPrefix(durable[key], "value")); err == nil && written < compacted {
+					t.Errorf("%s #%d: %s lost the compacted value %s, got %s", op, n, key, durable[key], value)
+				}
+			}
+			db.Close()
+		}
+	}
+}
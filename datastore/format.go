@@ -0,0 +1,209 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// The format of the records written by this version, recorded in the manifest.
+// Directories without a manifest hold segments of the original format (1): records
+// without sequence numbers, timestamps and checksums. They are upgraded when opened for writing.
+const formatVersion = 2
+
+// checkFormat tells whether the directory has segments of the original format
+// and fails if it has a format this version doesn't know.
+func checkFormat(fs FS, dir string) (legacy bool, err error) {
+	m, err := readManifest(fs, dir)
+	if err != nil || m != nil {
+		if err == nil && m.Format != formatVersion {
+			err = fmt.Errorf("%w: %s has format %d, expected %d", ErrUnsupportedFormat, dir, m.Format, formatVersion)
+		}
+		return false, err
+	}
+	segments, err := listSegments(fs, dir)
+	return len(segments) > 0, err
+}
+
+// errLegacyFormat is returned by the operations which can't upgrade a directory of the original format.
+func errLegacyFormat(dir string) error {
+	return fmt.Errorf("%w: %s has segments of the original format, open it for writing once to upgrade them", ErrUnsupportedFormat, dir)
+}
+
+// upgradeSuffix is added to the names of new segments until the upgrade is committed by the manifest
+const upgradeSuffix = "-upgrade"
+
+// upgrade rewrites segments of the original format into new ones, numbering the records in the order
+// they were written. The new segments are written under temporary names, so they aren't taken
+// for old ones after a crash. The manifest listing them commits the upgrade, and they are renamed
+// afterwards; the old segments are removed with the other orphans.
+func (db *Db) upgrade() error {
+	legacy, err := checkFormat(db.fs, db.dir)
+	if err != nil {
+		return err
+	}
+	if !legacy {
+		return db.finishUpgrade()
+	}
+	if db.readOnly {
+		return errLegacyFormat(db.dir)
+	}
+	segments, err := listSegments(db.fs, db.dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range segments {
+		if n := segmentNumber(name); n > db.segmentNumber {
+			db.segmentNumber = n
+		}
+	}
+
+	var (
+		upgraded []string
+		out      File
+		size     int64
+		seq      uint64
+	)
+	finish := func() error {
+		err := out.Sync()
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		out = nil
+		return err
+	}
+	for i, name := range segments {
+		path := filepath.Join(db.dir, name)
+		info, err := db.fs.Stat(path)
+		if err != nil {
+			return err
+		}
+		// The original format has no timestamps, the time of the last write of the segment is the closest
+		timestamp := info.ModTime().UnixNano()
+		err = readLegacySegment(db.fs, path, i == len(segments)-1, func(e *entry) error {
+			if out == nil || size >= db.segmentSize {
+				if out != nil {
+					if err := finish(); err != nil {
+						return err
+					}
+				}
+				newName := db.nextSegmentName()
+				f, err := db.fs.OpenFile(filepath.Join(db.dir, newName+upgradeSuffix), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+				if err != nil {
+					return err
+				}
+				out, size = f, 0
+				upgraded = append(upgraded, newName)
+			}
+			seq++
+			e.seq, e.timestamp = seq, timestamp
+			n, err := out.Write(e.Encode())
+			size += int64(n)
+			return err
+		})
+		if err != nil {
+			if out != nil {
+				out.Close()
+			}
+			return fmt.Errorf("can't upgrade %s: %w", path, err)
+		}
+	}
+	if out != nil {
+		if err := finish(); err != nil {
+			return err
+		}
+	}
+	m := manifest{Format: formatVersion, Segments: upgraded}
+	if err := m.write(db.fs, db.dir); err != nil {
+		return err
+	}
+	return db.finishUpgrade()
+}
+
+// finishUpgrade gives the segments of a committed upgrade their names.
+func (db *Db) finishUpgrade() error {
+	m, err := readManifest(db.fs, db.dir)
+	if err != nil || m == nil || db.readOnly {
+		return err
+	}
+	renamed := false
+	for _, name := range m.Segments {
+		path := filepath.Join(db.dir, name)
+		if _, err := db.fs.Stat(path + upgradeSuffix); err != nil {
+			continue
+		}
+		if err := db.fs.Rename(path+upgradeSuffix, path); err != nil {
+			return err
+		}
+		renamed = true
+	}
+	if renamed {
+		return db.fs.SyncDir(db.dir)
+	}
+	return nil
+}
+
+// readLegacySegment calls fn with every record of a segment of the original format.
+// A record cut off by the end of the last segment was never acknowledged and is skipped.
+func readLegacySegment(fs FS, path string, last bool, fn func(e *entry) error) error {
+	f, err := fs.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	for offset := 0; offset < len(data); {
+		e, size, err := decodeLegacy(data[offset:])
+		if errors.Is(err, errTorn) && last {
+			return nil
+		}
+		if err != nil {
+			return &recordError{int64(offset), err}
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+		offset += size
+	}
+	return nil
+}
+
+// decodeLegacy decodes a record of the original format at the beginning of data: record size,
+// key length, key, type and value, without a checksum. It returns the entry and the record size.
+func decodeLegacy(data []byte) (*entry, int, error) {
+	if len(data) < 8 {
+		return nil, 0, fmt.Errorf("%w: %d bytes left for the header", errTorn, len(data))
+	}
+	size := int(binary.LittleEndian.Uint32(data))
+	kl := int(binary.LittleEndian.Uint32(data[4:]))
+	if size < 8+kl+TYPE_SIZE {
+		return nil, 0, fmt.Errorf("invalid record size %d for key length %d", size, kl)
+	}
+	if size > len(data) {
+		return nil, 0, fmt.Errorf("%w: record size %d, %d bytes left", errTorn, size, len(data))
+	}
+	e := &entry{key: string(data[8 : 8+kl]), vType: data[8+kl]}
+	value := data[8+kl+TYPE_SIZE : size]
+	switch e.vType {
+	case STRING_TYPE:
+		if len(value) < 4 || int(binary.LittleEndian.Uint32(value)) > len(value)-4 {
+			return nil, 0, fmt.Errorf("string value doesn't fit record size %d", size)
+		}
+		e.value = string(value[4 : 4+binary.LittleEndian.Uint32(value)])
+	case INT64_TYPE:
+		if len(value) < 8 {
+			return nil, 0, fmt.Errorf("int64 value doesn't fit record size %d", size)
+		}
+		e.value = strconv.FormatInt(int64(binary.LittleEndian.Uint64(value)), 10)
+	default:
+		return nil, 0, fmt.Errorf("unknown value type %d", e.vType)
+	}
+	return e, size, nil
+}
@@ -0,0 +1,148 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// legacyString and legacyInt64 encode records of the original format, as the first version of the datastore did.
+func legacyString(key, value string) []byte {
+	vl := binary.LittleEndian.AppendUint32(nil, uint32(len(value)))
+	res := binary.LittleEndian.AppendUint32(nil, uint32(8+len(key)+TYPE_SIZE+4+len(value)))
+	res = binary.LittleEndian.AppendUint32(res, uint32(len(key)))
+	res = append(res, key...)
+	res = append(res, STRING_TYPE)
+	res = append(res, vl...)
+	return append(res, value...)
+}
+
+func legacyInt64(key string, value int64) []byte {
+	// The original format left 4 unused bytes after int64 values
+	res := binary.LittleEndian.AppendUint32(nil, uint32(8+len(key)+TYPE_SIZE+12))
+	res = binary.LittleEndian.AppendUint32(res, uint32(len(key)))
+	res = append(res, key...)
+	res = append(res, INT64_TYPE)
+	res = binary.LittleEndian.AppendUint64(res, uint64(value))
+	return append(res, 0, 0, 0, 0)
+}
+
+func TestDb_UpgradeLegacyFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	segments := map[string][][]byte{
+		"segment-1": {legacyString("a", "old"), legacyInt64("n", -7)},
+		// The last record is torn by a crash
+		"segment-2": {legacyString("a", "new"), legacyString("b", ""), legacyString("c", "torn")[:10]},
+	}
+	for name, records := range segments {
+		var data []byte
+		for _, r := range records {
+			data = append(data, r...)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := NewDb(dir, ReadOnly()); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Expected ErrUnsupportedFormat in read-only mode, got %v", err)
+	}
+	if err := Walk(dir, func(Record) error { return nil }); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Expected ErrUnsupportedFormat from Walk, got %v", err)
+	}
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]string{"a": "new", "b": "", "n": "-7"} {
+		if value, _, err := db.Lookup(key); err != nil || value != expected {
+			t.Errorf("Bad value of %s: %q, %v", key, value, err)
+		}
+	}
+	if _, err := db.Get("c"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the torn record to be dropped, got %v", err)
+	}
+	if history, err := db.History("a"); err != nil || len(history) != 2 || history[0].Seq >= history[1].Seq {
+		t.Errorf("Unexpected history of a: %+v, %v", history, err)
+	}
+	if err := db.Put("d", "after"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	m, err := readManifest(OS, dir)
+	if err != nil || m == nil || m.Format != formatVersion {
+		t.Fatalf("Unexpected manifest %+v: %v", m, err)
+	}
+	for name := range segments {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("Expected old segment %s to be removed, got %v", name, err)
+		}
+	}
+	var records []Record
+	if err := Walk(dir, func(r Record) error {
+		records = append(records, r)
+		return nil
+	}); err != nil || len(records) != 5 {
+		t.Errorf("Unexpected records after the upgrade: %+v, %v", records, err)
+	}
+}
+
+func TestDb_UnknownFormat(t *testing.T) {
+	fs := NewMemFS()
+	db, err := NewDb("db", WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	m, err := readManifest(fs, "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Format = formatVersion + 1
+	if err := m.write(fs, "db"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDb("db", WithFS(fs)); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Expected ErrUnsupportedFormat, got %v", err)
+	}
+}
+
+func TestDb_InterruptedUpgrade(t *testing.T) {
+	fs := NewMemFS()
+	db, err := NewDb("db", WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// A crash after the manifest of an upgrade is written, before its segments are renamed
+	m, err := readManifest(fs, "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join("db", m.Segments[0])
+	if err := fs.Rename(path, path+upgradeSuffix); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb("db", WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if value, err := db.Get("key"); err != nil || value != "value" {
+		t.Errorf("Bad value %q: %v", value, err)
+	}
+}
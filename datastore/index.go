@@ -0,0 +1,235 @@
+package datastore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Index declares a secondary index over a field of JSON values stored by keys with a prefix.
+type Index struct {
+	Name   string `json:"name"`
+	Prefix string `json:"prefix"`
+	// Dot-separated path of the field, such as "user.email"
+	Path string `json:"path"`
+}
+
+// fieldIndex maps values of the indexed field to the keys holding them.
+type fieldIndex struct {
+	Index
+	keys map[string]map[string]struct{}
+	// The indexed value of every key, so the key can be dropped when its value changes
+	values map[string]string
+}
+
+func newFieldIndex(idx Index) *fieldIndex {
+	return &fieldIndex{
+		Index:  idx,
+		keys:   make(map[string]map[string]struct{}),
+		values: make(map[string]string),
+	}
+}
+
+// update indexes the new value of the key. Values without the field drop the key from the index.
+func (fi *fieldIndex) update(key, value string) {
+	fi.remove(key)
+	field, ok := jsonField(value, fi.Path)
+	if !ok {
+		return
+	}
+	if fi.keys[field] == nil {
+		fi.keys[field] = make(map[string]struct{})
+	}
+	fi.keys[field][key] = struct{}{}
+	fi.values[key] = field
+}
+
+func (fi *fieldIndex) remove(key string) {
+	field, ok := fi.values[key]
+	if !ok {
+		return
+	}
+	delete(fi.values, key)
+	delete(fi.keys[field], key)
+	if len(fi.keys[field]) == 0 {
+		delete(fi.keys, field)
+	}
+}
+
+// jsonField returns the value at the dot-separated path of a JSON document as text.
+// Strings are returned as they are, numbers and booleans as their JSON literals.
+// Other values, such as objects or null, can't be indexed.
+func jsonField(doc, path string) (string, bool) {
+	dec := json.NewDecoder(strings.NewReader(doc))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return "", false
+	}
+	for _, name := range strings.Split(path, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if v, ok = obj[name]; !ok {
+			return "", false
+		}
+	}
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
+
+// index updates the secondary indexes with a record written to the block at the offset.
+func (db *Db) index(b *block, e *entry, offset int64) {
+	db.indexMu.Lock()
+	defer db.indexMu.Unlock()
+	value, loaded := e.value, false
+	for _, fi := range db.indexes {
+		if !strings.HasPrefix(e.key, fi.Prefix) {
+			continue
+		}
+		if e.vType != STRING_TYPE {
+			fi.remove(e.key)
+			continue
+		}
+		if !loaded && value == "" {
+			// Streamed values are not kept in memory
+			if out, err := b.read(offset); err == nil {
+				value = out.value
+			}
+		}
+		loaded = true
+		fi.update(e.key, value)
+	}
+}
+
+// buildIndex indexes the current values of keys. The caller holds db.mu.
+func (db *Db) buildIndex(idx Index) (*fieldIndex, error) {
+	fi := newFieldIndex(idx)
+	for key := range db.keys() {
+		if !strings.HasPrefix(key, idx.Prefix) {
+			continue
+		}
+		value, vType, err := db.value(key)
+		if err != nil {
+			return nil, err
+		}
+		if vType == "string" {
+			fi.update(key, value)
+		}
+	}
+	return fi, nil
+}
+
+// loadIndexes builds the indexes declared in the manifest.
+func (db *Db) loadIndexes() error {
+	m, err := readManifest(db.fs, db.dir)
+	if err != nil || m == nil {
+		return err
+	}
+	for _, idx := range m.Indexes {
+		fi, err := db.buildIndex(idx)
+		if err != nil {
+			return fmt.Errorf("can't build index %s: %w", idx.Name, err)
+		}
+		db.indexes[idx.Name] = fi
+	}
+	return nil
+}
+
+// CreateIndex declares a secondary index and builds it from the stored values.
+// Declared indexes are kept in the manifest and rebuilt whenever the database is opened.
+func (db *Db) CreateIndex(idx Index) error {
+	if idx.Name == "" || idx.Path == "" {
+		return errors.New("index needs a name and a field path")
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	if _, ok := db.indexes[idx.Name]; ok {
+		return fmt.Errorf("%w: %s", ErrIndexExists, idx.Name)
+	}
+	fi, err := db.buildIndex(idx)
+	if err != nil {
+		return err
+	}
+	db.setIndex(idx.Name, fi)
+	if err := db.writeManifest(); err != nil {
+		db.setIndex(idx.Name, nil)
+		return err
+	}
+	return nil
+}
+
+// DropIndex removes the declared index.
+func (db *Db) DropIndex(name string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	fi, ok := db.indexes[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNoIndex, name)
+	}
+	db.setIndex(name, nil)
+	if err := db.writeManifest(); err != nil {
+		db.setIndex(name, fi)
+		return err
+	}
+	return nil
+}
+
+// setIndex installs the index under the name, or removes it if fi is nil.
+func (db *Db) setIndex(name string, fi *fieldIndex) {
+	db.indexMu.Lock()
+	defer db.indexMu.Unlock()
+	if fi == nil {
+		delete(db.indexes, name)
+	} else {
+		db.indexes[name] = fi
+	}
+}
+
+// Indexes returns the declared indexes ordered by name.
+func (db *Db) Indexes() []Index {
+	db.indexMu.RLock()
+	defer db.indexMu.RUnlock()
+	indexes := make([]Index, 0, len(db.indexes))
+	for _, fi := range db.indexes {
+		indexes = append(indexes, fi.Index)
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		return indexes[i].Name < indexes[j].Name
+	})
+	return indexes
+}
+
+// FindBy returns the keys whose values have the given value of the field of the index, in ascending order.
+// Numbers and booleans are matched by their JSON literals.
+func (db *Db) FindBy(index, value string) ([]string, error) {
+	db.indexMu.RLock()
+	defer db.indexMu.RUnlock()
+	fi, ok := db.indexes[index]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNoIndex, index)
+	}
+	keys := make([]string, 0, len(fi.keys[value]))
+	for key := range fi.keys[value] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
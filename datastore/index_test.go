@@ -0,0 +1,121 @@
+package datastore
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDb_Index(t *testing.T) {
+	fs := NewMemFS()
+	db, err := NewDb("db", WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Put("user/1", `{"user": {"email": "a@example.com", "age": 30}}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateIndex(Index{Name: "email", Prefix: "user/", Path: "user.email"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateIndex(Index{Name: "age", Prefix: "user/", Path: "user.age"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateIndex(Index{Name: "age", Prefix: "user/", Path: "age"}); !errors.Is(err, ErrIndexExists) {
+		t.Errorf("Expected ErrIndexExists, got %v", err)
+	}
+
+	puts := [][]string{
+		{"user/2", `{"user": {"email": "b@example.com", "age": 30}}`},
+		{"user/3", `{"user": {"email": "a@example.com"}}`},
+		{"user/4", `not json`},
+		{"other/1", `{"user": {"email": "a@example.com"}}`},
+	}
+	for _, p := range puts {
+		if err := db.Put(p[0], p[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	value := `{"user": {"email": "c@example.com"}}`
+	if err := db.PutStream("user/5", strings.NewReader(value), int64(len(value))); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(t *testing.T, db *Db, index, value string, expected ...string) {
+		t.Helper()
+		keys, err := db.FindBy(index, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected == nil {
+			expected = []string{}
+		}
+		if !reflect.DeepEqual(keys, expected) {
+			t.Errorf("FindBy(%s, %s) = %v, expected %v", index, value, keys, expected)
+		}
+	}
+
+	t.Run("find", func(t *testing.T) {
+		check(t, db, "email", "a@example.com", "user/1", "user/3")
+		check(t, db, "email", "c@example.com", "user/5")
+		check(t, db, "age", "30", "user/1", "user/2")
+		if _, err := db.FindBy("missing", "x"); !errors.Is(err, ErrNoIndex) {
+			t.Errorf("Expected ErrNoIndex, got %v", err)
+		}
+	})
+
+	t.Run("update and delete", func(t *testing.T) {
+		if err := db.Put("user/3", `{"user": {"email": "b@example.com"}}`); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Delete("user/1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.PutInt64("user/2", 1); err != nil {
+			t.Fatal(err)
+		}
+		check(t, db, "email", "a@example.com")
+		check(t, db, "email", "b@example.com", "user/3")
+		check(t, db, "age", "30")
+	})
+
+	t.Run("recovery", func(t *testing.T) {
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+		db, err = NewDb("db", WithFS(fs))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if indexes := db.Indexes(); len(indexes) != 2 || indexes[1].Path != "user.email" {
+			t.Errorf("Unexpected indexes after reopening: %v", indexes)
+		}
+		check(t, db, "email", "b@example.com", "user/3")
+		check(t, db, "email", "c@example.com", "user/5")
+
+		if err := db.DropIndex("age"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.FindBy("age", "30"); !errors.Is(err, ErrNoIndex) {
+			t.Errorf("Expected ErrNoIndex, got %v", err)
+		}
+	})
+}
+
+func TestJsonField(t *testing.T) {
+	doc := `{"a": {"b": "text", "n": 1.50, "t": true, "z": null, "o": {}}}`
+	for path, expected := range map[string]string{"a.b": "text", "a.n": "1.50", "a.t": "true"} {
+		if value, ok := jsonField(doc, path); !ok || value != expected {
+			t.Errorf("Field %s = %s (%t), expected %s", path, value, ok, expected)
+		}
+	}
+	for _, path := range []string{"a", "a.z", "a.o", "a.b.c", "x"} {
+		if value, ok := jsonField(doc, path); ok {
+			t.Errorf("Field %s is not expected to be indexed, got %s", path, value)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package datastore
+
+import "os"
+
+// lockFile only creates the file, as file locks are not supported on this platform.
+func lockFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+}
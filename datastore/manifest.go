@@ -0,0 +1,114 @@
+package datastore
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// The file listing live segments of a database
+const manifestFileName = "MANIFEST"
+
+// A new manifest is written here first and then renamed over the old one
+const manifestTempFileName = manifestFileName + "-temp"
+
+// manifest is the content of the MANIFEST file.
+type manifest struct {
+	// The format of the records of the segments, see formatVersion
+	Format int `json:"format"`
+	// Live segments in the order they were written
+	Segments []string `json:"segments"`
+	// Declared secondary indexes
+	Indexes []Index `json:"indexes,omitempty"`
+	// The last sequence number given out, which merges can drop from the segments with a tombstone
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+var segmentNameRegexp = regexp.MustCompile("^" + outFileName + "([0-9]+)$")
+
+// segmentNumber returns the number in the name of a segment file, or -1 if it is not a segment name.
+func segmentNumber(fileName string) int {
+	match := segmentNameRegexp.FindStringSubmatch(fileName)
+	if match == nil {
+		return -1
+	}
+	n, err := strconv.Atoi(match[1])
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// readManifest reads the manifest of the directory, or returns nil if there is none.
+func readManifest(fs FS, dir string) (*manifest, error) {
+	data, err := readFile(fs, filepath.Join(dir, manifestFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// write atomically replaces the manifest of the directory.
+func (m *manifest) write(fs FS, dir string) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tempPath := filepath.Join(dir, manifestTempFileName)
+	f, err := fs.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fs.Remove(tempPath)
+		return err
+	}
+	if err := fs.Rename(tempPath, filepath.Join(dir, manifestFileName)); err != nil {
+		return err
+	}
+	return fs.SyncDir(dir)
+}
+
+// listSegments returns live segments of the directory in the order they were written.
+// Directories created before the manifest was introduced have all their segments ordered by number.
+func listSegments(fs FS, dir string) ([]string, error) {
+	m, err := readManifest(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	if m != nil {
+		return m.Segments, nil
+	}
+
+	filesNames, err := fs.ReadDirNames(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []string
+	for _, fileName := range filesNames {
+		if segmentNumber(fileName) >= 0 {
+			segments = append(segments, fileName)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segmentNumber(segments[i]) < segmentNumber(segments[j])
+	})
+	return segments, nil
+}
@@ -0,0 +1,94 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestDb_Manifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Roll over to a new segment on every write, merging the older ones
+	db.segmentSize = 0
+	for i := 0; i < 12; i++ {
+		if err := db.Put("key"+strconv.Itoa(i%4), "value"+strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	segments, err := listSegments(OS, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 2 || segmentNumber(segments[0]) < 10 || segmentNumber(segments[1]) <= segmentNumber(segments[0]) {
+		t.Fatalf("Unexpected segments after merges: %v", segments)
+	}
+
+	// Leftovers of an interrupted merge and an unrelated file
+	leftovers := []string{"segment-100", "segment-3-temp", manifestTempFileName}
+	for _, name := range append(leftovers, "notes.txt") {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("garbage"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err = NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 8; i < 12; i++ {
+		value, err := db.Get("key" + strconv.Itoa(i%4))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != "value"+strconv.Itoa(i) {
+			t.Errorf("Bad value returned expected value%d, got %s", i, value)
+		}
+	}
+	for _, name := range leftovers {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed, got %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err != nil {
+		t.Errorf("Unrelated file was touched: %v", err)
+	}
+}
+
+func TestListSegments_WithoutManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"segment-10", "segment-2", "segment-1", "segment-2-temp", lockFileName} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	segments, err := listSegments(OS, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"segment-1", "segment-2", "segment-10"}; !reflect.DeepEqual(segments, expected) {
+		t.Errorf("Expected %v, got %v", expected, segments)
+	}
+}
@@ -0,0 +1,27 @@
+package datastore
+
+import "time"
+
+// Op names an operation reported to an Observer.
+type Op string
+
+const (
+	OpGet Op = "get"
+	OpPut Op = "put"
+	// Time a write waits for the writer of the active segment, a part of OpPut
+	OpQueue Op = "queue"
+	OpMerge Op = "merge"
+	// Periodic sync of the active segment, see WithSyncInterval
+	OpSync Op = "sync"
+)
+
+// Observer is called with the duration and the result of every finished operation.
+// It is called synchronously by the goroutine doing the operation, so it has to be fast
+// and safe for concurrent use.
+type Observer func(op Op, d time.Duration, err error)
+
+func (db *Db) observe(op Op, d time.Duration, err error) {
+	if db.observer != nil {
+		db.observer(op, d, err)
+	}
+}
@@ -0,0 +1,100 @@
+package datastore
+
+import "time"
+
+// Option configures a Db created by NewDb.
+type Option func(*Db)
+
+// WithMaxVersions makes merges keep up to n most recent versions of every key.
+// By default only the latest version survives a merge.
+func WithMaxVersions(n int) Option {
+	return func(db *Db) {
+		db.retention.versions = n
+	}
+}
+
+// WithRetention makes merges keep all versions written during the last d,
+// in addition to the ones kept by WithMaxVersions.
+func WithRetention(d time.Duration) Option {
+	return func(db *Db) {
+		db.retention.window = d
+	}
+}
+
+// WithMaxKeySize limits the length of keys. Longer keys are rejected with ErrKeyTooLarge.
+func WithMaxKeySize(n int64) Option {
+	return func(db *Db) {
+		db.maxKeySize = n
+	}
+}
+
+// WithMaxValueSize limits the size of string values. Larger values are rejected with ErrValueTooLarge.
+func WithMaxValueSize(n int64) Option {
+	return func(db *Db) {
+		db.maxValueSize = n
+	}
+}
+
+// WithMaxDiskSize limits the total size of segments. A write that doesn't fit compacts the database first,
+// and fails with ErrQuotaExceeded if that doesn't free enough space.
+// Merges temporarily need extra space for the merged segment, which the quota doesn't include.
+func WithMaxDiskSize(n int64) Option {
+	return func(db *Db) {
+		db.maxDiskSize = n
+	}
+}
+
+// WithSegmentSize makes the Db start a new segment once the active one grows past n bytes.
+func WithSegmentSize(n int64) Option {
+	return func(db *Db) {
+		db.segmentSize = n
+	}
+}
+
+// WithMergeThreshold makes the Db merge its inactive segments once there are n of them, 2 by default.
+// With n = 0 segments are merged only by Compact.
+func WithMergeThreshold(n int) Option {
+	return func(db *Db) {
+		db.mergeThreshold = n
+	}
+}
+
+// WithSyncWrites makes every write sync the active segment to stable storage before it is reported done.
+// By default syncing is left to the OS, so a crash of the machine can lose the latest writes.
+func WithSyncWrites() Option {
+	return func(db *Db) {
+		db.syncWrites = true
+	}
+}
+
+// WithSyncInterval makes the Db sync the active segment every d,
+// so a crash of the machine loses at most the writes of the last d.
+// Failures are reported to the observer as OpSync.
+func WithSyncInterval(d time.Duration) Option {
+	return func(db *Db) {
+		db.syncInterval = d
+	}
+}
+
+// WithFS makes the Db keep its files in fs instead of the file system of the OS.
+func WithFS(fs FS) Option {
+	return func(db *Db) {
+		db.fs = fs
+	}
+}
+
+// ReadOnly opens an existing database without claiming its directory, so it can be used
+// alongside a Db that writes to it. Such a Db reads the state the directory had when it was opened,
+// and all writes to it fail with ErrReadOnly.
+func ReadOnly() Option {
+	return func(db *Db) {
+		db.readOnly = true
+	}
+}
+
+// WithObserver reports the duration of every operation to o.
+func WithObserver(o Observer) Option {
+	return func(db *Db) {
+		db.observer = o
+	}
+}
@@ -0,0 +1,98 @@
+package datastore
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+// Snapshot is a read-only view of the values the database had when the snapshot was taken.
+// Later writes and merges don't change it. It has to be closed once it is no longer needed.
+type Snapshot struct {
+	// Sorted by key
+	entries []snapshotEntry
+	// Separate descriptors of the segments, so they stay readable if a merge removes them
+	segments []File
+	// The size of every segment when the snapshot was taken
+	ends []int64
+}
+
+type snapshotEntry struct {
+	key     string
+	segment int
+	offset  int64
+}
+
+// Snapshot takes a snapshot of the current values of the keys starting with prefix.
+func (db *Db) Snapshot(prefix string) (*Snapshot, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	s := &Snapshot{}
+	latest := make(map[string]snapshotEntry)
+	// Only the active block changes while the lock is held, and its index is read at once
+	for i, b := range db.blocks {
+		b.mu.RLock()
+		for key, vs := range b.index {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			if v := vs[len(vs)-1]; v.tombstone {
+				delete(latest, key)
+			} else {
+				latest[key] = snapshotEntry{key, i, v.offset}
+			}
+		}
+		s.ends = append(s.ends, b.outOffset)
+		b.mu.RUnlock()
+	}
+	for _, b := range db.blocks {
+		f, err := db.fs.OpenFile(b.outPath, os.O_RDONLY, 0)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.segments = append(s.segments, f)
+	}
+	s.entries = make([]snapshotEntry, 0, len(latest))
+	for _, e := range latest {
+		s.entries = append(s.entries, e)
+	}
+	sort.Slice(s.entries, func(i, j int) bool {
+		return s.entries[i].key < s.entries[j].key
+	})
+	return s, nil
+}
+
+// Len returns the number of keys in the snapshot.
+func (s *Snapshot) Len() int {
+	return len(s.entries)
+}
+
+// ForEach calls fn with every key of the snapshot, in ascending order, and its value and type.
+// It stops at the first error returned by fn.
+func (s *Snapshot) ForEach(fn func(key, vType, value string) error) error {
+	for _, e := range s.entries {
+		out, err := readRecord(s.segments[e.segment], e.offset, s.ends[e.segment])
+		if err != nil {
+			return err
+		}
+		if err := fn(e.key, out.vType, out.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Snapshot) Close() error {
+	var err error
+	for _, f := range s.segments {
+		if closeErr := f.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	s.segments = nil
+	return err
+}
@@ -0,0 +1,57 @@
+package datastore
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDb_Snapshot(t *testing.T) {
+	db, err := NewDb("db", WithFS(NewMemFS()), WithSegmentSize(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"a/2", "a/1", "b/1", "a/3"} {
+		if err := db.Put(key, "old "+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.PutInt64("a/4", 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("a/3"); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := db.Snapshot("a/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// Changes and merges after the snapshot is taken don't affect it
+	if err := db.Put("a/1", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("a/2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("a/5", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	err = s.ForEach(func(key, vType, value string) error {
+		got = append(got, key+" "+vType+" "+value)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"a/1 string old a/1", "a/2 string old a/2", "a/4 int64 4"}
+	if !reflect.DeepEqual(got, expected) || s.Len() != len(expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
@@ -0,0 +1,120 @@
+package datastore
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// PutStream stores a string value of the given size read from r.
+// The value is first copied to a temporary file in the database directory, so neither
+// the whole value is kept in memory, nor other writes wait for a slow reader.
+func (db *Db) PutStream(key string, r io.Reader, size int64) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if size < 0 {
+		return fmt.Errorf("can't store a value of %d bytes", size)
+	}
+	if err := db.checkSize(key, size); err != nil {
+		return err
+	}
+	// The file name starts like a segment, so it is removed on recovery if the process crashes
+	temp, err := db.fs.CreateTemp(db.dir, db.segmentName+"stream-*")
+	if err != nil {
+		return err
+	}
+	defer db.fs.Remove(temp.Name())
+	defer temp.Close()
+
+	n, err := io.CopyN(temp, r, size)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("can't read value (read %d of %d bytes): %w", n, size, err)
+	}
+	if _, err := temp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	e := entry{key: key, vType: STRING_TYPE}
+	ctx := context.Background()
+	return db.write(ctx, e, encodedSize(key, 4+size), func(b *block, e entry) (time.Duration, error) {
+		return b.putStream(ctx, e, temp, size)
+	})
+}
+
+// GetStream writes the string value stored by key to w.
+// The checksum of the value can only be checked after it is written, so w may receive
+// a damaged value before GetStream reports the error.
+func (db *Db) GetStream(key string, w io.Writer) error {
+	f, position, err := db.openLatest(key)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	in := bufio.NewReaderSize(io.NewSectionReader(f, position, math.MaxInt64-position), bufSize)
+	sum := crc32.NewIEEE()
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return err
+	}
+	// The rest of the record up to the value: key, type and value length
+	kl := int(binary.LittleEndian.Uint32(header[4:]))
+	prefix := make([]byte, kl+TYPE_SIZE+4)
+	if _, err := io.ReadFull(in, prefix); err != nil {
+		return err
+	}
+	if prefix[kl] != STRING_TYPE {
+		return &WrongTypeError{"string", ToType(prefix[kl])}
+	}
+	sum.Write(header)
+	sum.Write(prefix)
+	vl := int64(binary.LittleEndian.Uint32(prefix[kl+TYPE_SIZE:]))
+	if _, err := io.CopyN(io.MultiWriter(w, sum), in, vl); err != nil {
+		return err
+	}
+
+	expected := sum.Sum32()
+	var stored [checksumSize]byte
+	if _, err := io.ReadFull(in, stored[:]); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(stored[:]) != expected {
+		return fmt.Errorf("%w: checksum mismatch in the value of %s", ErrCorrupted, key)
+	}
+	return nil
+}
+
+// openLatest opens a separate descriptor of the segment holding the latest version of the key,
+// so it can be read after the lock is released, even if the segment is removed by a merge meanwhile.
+func (db *Db) openLatest(key string) (File, int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, 0, ErrClosed
+	}
+	for j := len(db.blocks) - 1; j >= 0; j = j - 1 {
+		vs := db.blocks[j].versions(key)
+		if len(vs) == 0 {
+			continue
+		}
+		if vs[len(vs)-1].tombstone {
+			return nil, 0, ErrNotFound
+		}
+		f, err := db.fs.OpenFile(db.blocks[j].outPath, os.O_RDONLY, 0)
+		if err != nil {
+			return nil, 0, err
+		}
+		return f, vs[len(vs)-1].offset, nil
+	}
+	return nil, 0, ErrNotFound
+}
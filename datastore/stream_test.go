@@ -0,0 +1,79 @@
+package datastore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDb_Stream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	value := make([]byte, 3<<20)
+	rand.New(rand.NewSource(1)).Read(value)
+
+	t.Run("put/get", func(t *testing.T) {
+		err := db.PutStream("blob", iotest.HalfReader(bytes.NewReader(value)), int64(len(value)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if err := db.GetStream("blob", &out); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), value) {
+			t.Error("Streamed value differs from the stored one")
+		}
+		stored, err := db.Get("blob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored != string(value) {
+			t.Error("Get returned a different value")
+		}
+	})
+
+	t.Run("short body", func(t *testing.T) {
+		err := db.PutStream("short", strings.NewReader("abc"), 10)
+		if err == nil {
+			t.Error("Expected an error for a body shorter than its size")
+		}
+		if _, err := db.Get("short"); err != ErrNotFound {
+			t.Errorf("Expected nothing stored, got %v", err)
+		}
+		if err := db.Put("after", "value"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("wrong type", func(t *testing.T) {
+		if err := db.PutInt64("number", 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.GetStream("number", ioutil.Discard); err == nil {
+			t.Error("Expected an error for an int64 value")
+		}
+	})
+
+	problems, err := Verify(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("Unexpected problems: %v", problems)
+	}
+}
@@ -0,0 +1,67 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+)
+
+// Wait blocks until the key has a version newer than the one with the sequence number after,
+// and returns it. With after 0 it returns the current version, waiting for the key to be written
+// if it has none. If the key had the version after, but was deleted since, Wait returns ErrNotFound.
+// It returns the error of ctx if the key doesn't change before ctx is done.
+func (db *Db) Wait(ctx context.Context, key string, after uint64) (Version, error) {
+	for {
+		// Watched before reading, so a write in between isn't missed
+		changed := db.watch(key)
+		v, err := db.Latest(key)
+		switch {
+		case err == nil && v.Seq > after:
+			return v, nil
+		case errors.Is(err, ErrNotFound):
+			if after != 0 {
+				return Version{}, err
+			}
+		case err != nil:
+			return Version{}, err
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return Version{}, ctx.Err()
+		}
+	}
+}
+
+// watch returns a channel closed by the next write of the key.
+func (db *Db) watch(key string) <-chan struct{} {
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	if db.watchers == nil {
+		db.watchers = make(map[string]chan struct{})
+	}
+	ch, ok := db.watchers[key]
+	if !ok {
+		ch = make(chan struct{})
+		db.watchers[key] = ch
+	}
+	return ch
+}
+
+// notify wakes up the waiters of the key after it is written.
+func (db *Db) notify(key string) {
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	if ch, ok := db.watchers[key]; ok {
+		close(ch)
+		delete(db.watchers, key)
+	}
+}
+
+func (db *Db) notifyAll() {
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	for key, ch := range db.watchers {
+		close(ch)
+		delete(db.watchers, key)
+	}
+}
@@ -0,0 +1,98 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDb_Wait(t *testing.T) {
+	db, err := NewDb("db", WithFS(NewMemFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	wait := func(key string, after uint64, timeout time.Duration) <-chan error {
+		done := make(chan error, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			v, err := db.Wait(ctx, key, after)
+			if err == nil && v.Value != "new" {
+				err = errors.New("unexpected value " + v.Value)
+			}
+			done <- err
+		}()
+		return done
+	}
+
+	t.Run("creation", func(t *testing.T) {
+		done := wait("k", 0, time.Second)
+		time.Sleep(10 * time.Millisecond)
+		if err := db.Put("k", "new"); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("change", func(t *testing.T) {
+		v, err := db.Latest("k")
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := wait("k", v.Seq, time.Second)
+		// Other keys don't wake the waiter up
+		if err := db.Put("other", "value"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		if err := db.Put("k", "new"); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+		// A newer version is returned right away
+		if err := <-wait("k", v.Seq, time.Second); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		v, err := db.Latest("k")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := <-wait("k", v.Seq, 20*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected a timeout, got %v", err)
+		}
+	})
+
+	t.Run("deletion", func(t *testing.T) {
+		v, err := db.Latest("k")
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := wait("k", v.Seq, time.Second)
+		time.Sleep(10 * time.Millisecond)
+		if err := db.Delete("k"); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-done; !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		done := wait("k", 0, time.Second)
+		time.Sleep(10 * time.Millisecond)
+		db.Close()
+		if err := <-done; !errors.Is(err, ErrClosed) {
+			t.Errorf("Expected ErrClosed, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,109 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Record is a single entry as it is laid out in a segment file.
+type Record struct {
+	Segment   string
+	Offset    int64
+	Seq       uint64
+	Timestamp time.Time
+	Key       string
+	Type      string
+	Value     string
+}
+
+// Problem describes a damaged part of a segment file found by Verify.
+type Problem struct {
+	Segment string
+	Offset  int64
+	Err     error
+}
+
+func (p Problem) Error() string {
+	return fmt.Sprintf("%s at offset %d: %s", p.Segment, p.Offset, p.Err)
+}
+
+// Walk calls fn for every record stored in dir, segment by segment in the order they were written.
+// It does not need the database to be opened, so it also works on directories NewDb refuses to recover.
+func Walk(dir string, fn func(Record) error) error {
+	segments, err := currentSegments(dir)
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		err := walkSegment(segment, filepath.Join(dir, segment), func(offset int64, data []byte) error {
+			var e entry
+			e.Decode(data)
+			return fn(Record{segment, offset, e.seq, time.Unix(0, e.timestamp), e.key, ToType(e.vType), e.value})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Verify checks the structure and checksums of every segment in dir.
+// Checking a segment stops at its first damaged record, as the records after it can't be located reliably.
+func Verify(dir string) ([]Problem, error) {
+	segments, err := currentSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	var problems []Problem
+	for _, segment := range segments {
+		err := walkSegment(segment, filepath.Join(dir, segment), func(int64, []byte) error {
+			return nil
+		})
+		var p Problem
+		if errors.As(err, &p) {
+			problems = append(problems, p)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return problems, nil
+}
+
+// currentSegments lists the segments of dir, which have to be in the current format.
+func currentSegments(dir string) ([]string, error) {
+	legacy, err := checkFormat(OS, dir)
+	if err == nil && legacy {
+		err = errLegacyFormat(dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return listSegments(OS, dir)
+}
+
+// walkSegment calls fn for every valid record of a segment and reports the first damaged one as a Problem.
+func walkSegment(segment, path string, fn func(offset int64, data []byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	err = scanRecords(f, info.Size(), func(offset int64, data []byte) error {
+		if err := validate(data); err != nil {
+			return &recordError{offset, err}
+		}
+		return fn(offset, data)
+	})
+	var re *recordError
+	if errors.As(err, &re) {
+		return Problem{segment, re.offset, re.err}
+	}
+	return err
+}
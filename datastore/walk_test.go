@@ -0,0 +1,73 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWalkAndVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key1", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutInt64("key2", 42); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	var records []Record
+	err = Walk(dir, func(r Record) error {
+		records = append(records, r)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, got %d", len(records))
+	}
+	if r := records[1]; r.Key != "key2" || r.Type != "int64" || r.Value != "42" || r.Offset == 0 {
+		t.Errorf("Unexpected record %+v", r)
+	}
+
+	problems, err := Verify(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("Unexpected problems in a healthy directory: %v", problems)
+	}
+
+	// Flip a byte of the second record's value
+	path := filepath.Join(dir, records[1].Segment)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-6] ^= 0xff
+	if err := ioutil.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err = Verify(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || problems[0].Offset != records[1].Offset {
+		t.Errorf("Expected a problem at offset %d, got %v", records[1].Offset, problems)
+	}
+	if _, err := NewDb(dir); err == nil {
+		t.Error("Expected NewDb to reject a corrupted segment")
+	}
+}
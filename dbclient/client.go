@@ -0,0 +1,433 @@
+// Package dbclient is a client of the HTTP API of the db service.
+package dbclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultRetries = 3
+	DefaultBackoff = 50 * time.Millisecond
+	// The longest pause between retries
+	maxBackoff = 2 * time.Second
+)
+
+// Client calls the db service. It is safe for concurrent use and reuses connections,
+// so a single Client should be shared by all callers.
+type Client struct {
+	baseURL string
+	http    *http.Client
+	retries int
+	backoff time.Duration
+	// Sent as the bearer token of every request if not empty
+	token string
+}
+
+// Option configures a Client created by New.
+type Option func(*Client)
+
+// WithHTTPClient makes the Client send requests with hc.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.http = hc
+	}
+}
+
+// WithRetries makes the Client repeat a request up to n more times when the service can't be reached
+// or is temporarily unavailable. The pause before a retry starts at backoff and doubles after each attempt.
+// Batches and conditional puts are repeated only if they can't have been applied, such as when the connection is refused.
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries = n
+		c.backoff = backoff
+	}
+}
+
+// WithToken makes the Client authenticate with the bearer token, needed when the service is started with -auth-file.
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// New creates a client of the service at baseURL, such as "http://db:8100".
+func New(baseURL string, opts ...Option) *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Servers keep many requests in flight to the same database
+	transport.MaxIdleConnsPerHost = 32
+	c := &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		http:    &http.Client{Transport: transport, Timeout: 10 * time.Second},
+		retries: DefaultRetries,
+		backoff: DefaultBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Get returns the string value of the key.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	var data struct {
+		Value string `json:"value"`
+	}
+	_, err := c.do(ctx, http.MethodGet, keyPath(key, ""), nil, nil, &data)
+	return data.Value, err
+}
+
+// GetVersion returns the string value of the key together with its version, an opaque ETag
+// to pass to PutIfVersion.
+func (c *Client) GetVersion(ctx context.Context, key string) (string, string, error) {
+	var data struct {
+		Value string `json:"value"`
+	}
+	header, err := c.do(ctx, http.MethodGet, keyPath(key, ""), nil, nil, &data)
+	if err != nil {
+		return "", "", err
+	}
+	return data.Value, header.Get("etag"), nil
+}
+
+// GetInt64Version is GetVersion for int64 values.
+func (c *Client) GetInt64Version(ctx context.Context, key string) (int64, string, error) {
+	var data struct {
+		Value int64 `json:"value"`
+	}
+	header, err := c.do(ctx, http.MethodGet, keyPath(key, "int64"), nil, nil, &data)
+	if err != nil {
+		return 0, "", err
+	}
+	return data.Value, header.Get("etag"), nil
+}
+
+// Wait waits up to timeout for the string value of the key to get a version newer than the given one,
+// and returns the new value and version. With the empty version it returns the current value, waiting
+// only if the key doesn't exist yet. If the key doesn't change in time, it returns ErrNotChanged.
+func (c *Client) Wait(ctx context.Context, key, version string, timeout time.Duration) (string, string, error) {
+	query := url.Values{"wait": {timeout.String()}}
+	if version != "" {
+		query.Set("after", version)
+	}
+	// The request lasts as long as the wait
+	wc, hc := *c, *c.http
+	if hc.Timeout > 0 {
+		hc.Timeout += timeout
+	}
+	wc.http = &hc
+	var data struct {
+		Value string `json:"value"`
+	}
+	header, err := wc.do(ctx, http.MethodGet, keyPath(key, "")+"?"+query.Encode(), nil, nil, &data)
+	var e *Error
+	if errors.As(err, &e) && e.Status == http.StatusNotModified {
+		return "", version, ErrNotChanged
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return data.Value, header.Get("etag"), nil
+}
+
+// GetInt64 returns the int64 value of the key.
+func (c *Client) GetInt64(ctx context.Context, key string) (int64, error) {
+	var data struct {
+		Value int64 `json:"value"`
+	}
+	_, err := c.do(ctx, http.MethodGet, keyPath(key, "int64"), nil, nil, &data)
+	return data.Value, err
+}
+
+// Put stores the string value by the key. Empty values are rejected by the service.
+func (c *Client) Put(ctx context.Context, key, value string) error {
+	_, err := c.put(ctx, key, "string", value, nil)
+	return err
+}
+
+// PutInt64 stores the int64 value by the key.
+func (c *Client) PutInt64(ctx context.Context, key string, value int64) error {
+	_, err := c.put(ctx, key, "int64", value, nil)
+	return err
+}
+
+// PutIfVersion stores the string value by the key only if its current version is the one returned
+// by GetVersion or an earlier PutIfVersion, and returns the new version. The empty version means the key
+// must not exist yet. Otherwise it fails with ErrConditionFailed, and the value has to be read again.
+func (c *Client) PutIfVersion(ctx context.Context, key, value, version string) (string, error) {
+	return c.put(ctx, key, "string", value, ifVersion(version))
+}
+
+// PutInt64IfVersion is PutIfVersion for int64 values, with versions returned by GetInt64Version.
+func (c *Client) PutInt64IfVersion(ctx context.Context, key string, value int64, version string) (string, error) {
+	return c.put(ctx, key, "int64", value, ifVersion(version))
+}
+
+// ifVersion returns the header of a request made only if the key has the version.
+func ifVersion(version string) http.Header {
+	header := http.Header{}
+	if version == "" {
+		header.Set("if-none-match", "*")
+	} else {
+		header.Set("if-match", version)
+	}
+	return header
+}
+
+// IncrBy adds delta to the int64 value of the key, a missing key counting as 0, and returns the result.
+// If another client changes the value meanwhile, the addition is retried with the new one.
+// A result which doesn't fit int64 fails with ErrOverflow, and the value stays as it is.
+func (c *Client) IncrBy(ctx context.Context, key string, delta int64) (int64, error) {
+	for {
+		n, version, err := c.GetInt64Version(ctx, key)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return 0, err
+		}
+		if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+			return 0, ErrOverflow
+		}
+		_, err = c.PutInt64IfVersion(ctx, key, n+delta, version)
+		if errors.Is(err, ErrConditionFailed) {
+			continue
+		}
+		return n + delta, err
+	}
+}
+
+// Stats describes the state of the database.
+type Stats struct {
+	Segments int   `json:"segments"`
+	Size     int64 `json:"size"`
+	Keys     int   `json:"keys"`
+}
+
+// Stats returns the number of segments, their total size and the number of keys of the database.
+func (c *Client) Stats(ctx context.Context) (Stats, error) {
+	var stats Stats
+	_, err := c.do(ctx, http.MethodGet, "/stats", nil, nil, &stats)
+	return stats, err
+}
+
+func (c *Client) put(ctx context.Context, key, vType string, value interface{}, header http.Header) (string, error) {
+	body, err := json.Marshal(struct {
+		Type  string      `json:"type"`
+		Value interface{} `json:"value"`
+	}{vType, value})
+	if err != nil {
+		return "", err
+	}
+	respHeader, err := c.do(ctx, http.MethodPut, keyPath(key, ""), header, body, nil)
+	if err != nil {
+		return "", err
+	}
+	return respHeader.Get("etag"), nil
+}
+
+// Delete removes the key. A retried deletion can report ErrNotFound if an earlier attempt succeeded.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	_, err := c.do(ctx, http.MethodDelete, keyPath(key, ""), nil, nil, nil)
+	return err
+}
+
+// Scan returns all keys starting with prefix in ascending order, fetching them a page at a time.
+func (c *Client) Scan(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	cursor := ""
+	for {
+		page, next, err := c.ScanPage(ctx, prefix, cursor, 0)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, page...)
+		if next == "" {
+			return keys, nil
+		}
+		cursor = next
+	}
+}
+
+// ScanPage returns up to limit keys starting with prefix, or as many as the service gives if limit is 0.
+// The page starts after the one the cursor was returned with, or at the first key if the cursor is empty.
+// The returned cursor is empty after the last page.
+func (c *Client) ScanPage(ctx context.Context, prefix, cursor string, limit int) ([]string, string, error) {
+	query := url.Values{"prefix": {prefix}}
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	var data struct {
+		Keys   []string `json:"keys"`
+		Cursor string   `json:"cursor"`
+	}
+	_, err := c.do(ctx, http.MethodGet, "/db/?"+query.Encode(), nil, nil, &data)
+	return data.Keys, data.Cursor, err
+}
+
+func keyPath(key, vType string) string {
+	path := "/db/" + url.PathEscape(key)
+	if vType != "" {
+		path += "?type=" + vType
+	}
+	return path
+}
+
+// do sends the request with the header, retrying it if needed, and decodes the JSON response into out
+// unless it is nil. It returns the header of the response.
+func (c *Client) do(ctx context.Context, method, path string, header http.Header, body []byte, out interface{}) (http.Header, error) {
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		respHeader, err := c.send(ctx, method, path, header, body, out)
+		if err == nil || attempt >= c.retries || !retryable(err, idempotent(method, header)) {
+			return respHeader, err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, err
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, method, path string, header http.Header, body []byte, out interface{}) (http.Header, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, r)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.Header.Set("content-type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		// The connection is reused only once the body is read to the end
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	if resp.StatusCode >= 300 {
+		return resp.Header, responseError(resp)
+	}
+	if out == nil {
+		return resp.Header, nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return resp.Header, fmt.Errorf("can't decode the response of %s %s: %w", method, path, err)
+	}
+	return resp.Header, nil
+}
+
+// responseError reads the JSON error of the service, or makes one up if the body is not one.
+func responseError(resp *http.Response) error {
+	e := &Error{Status: resp.StatusCode}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(data, e) != nil || e.Code == "" {
+		e.Code = "http_" + strconv.Itoa(resp.StatusCode)
+		e.Message = strings.TrimSpace(string(data))
+	}
+	return e
+}
+
+// Op is an operation of a batch, made with PutOp, PutInt64Op or DeleteOp.
+type Op struct {
+	Op    string      `json:"op"`
+	Key   string      `json:"key"`
+	Type  string      `json:"type,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+func PutOp(key, value string) Op {
+	return Op{"put", key, "string", value}
+}
+
+func PutInt64Op(key string, value int64) Op {
+	return Op{"put", key, "int64", value}
+}
+
+func DeleteOp(key string) Op {
+	return Op{Op: "delete", Key: key}
+}
+
+// Batch applies the operations in one request. The batch is not atomic: it returns the error of every
+// operation, nil for the ones that succeeded. The error is not nil only if the batch was rejected as a whole.
+func (c *Client) Batch(ctx context.Context, ops ...Op) ([]error, error) {
+	body, err := json.Marshal(ops)
+	if err != nil {
+		return nil, err
+	}
+	var data struct {
+		Results []struct {
+			Status int    `json:"status"`
+			Error  *Error `json:"error"`
+		} `json:"results"`
+	}
+	if _, err := c.do(ctx, http.MethodPost, "/db/_batch", nil, body, &data); err != nil {
+		return nil, err
+	}
+	errs := make([]error, len(data.Results))
+	for i, result := range data.Results {
+		if result.Error != nil {
+			result.Error.Status = result.Status
+			errs[i] = result.Error
+		}
+	}
+	return errs, nil
+}
+
+// Entry is a value returned by MGet together with its type, "string" or "int64".
+// int64 values are in decimal.
+type Entry struct {
+	Type  string
+	Value string
+}
+
+// MGet returns the values of the keys in one request. Missing keys are left out of the result.
+func (c *Client) MGet(ctx context.Context, keys ...string) (map[string]Entry, error) {
+	query := url.Values{"key": keys}
+	var data struct {
+		Entries []struct {
+			Key   string          `json:"key"`
+			Type  string          `json:"type"`
+			Value json.RawMessage `json:"value"`
+		} `json:"entries"`
+	}
+	if _, err := c.do(ctx, http.MethodGet, "/db/_mget?"+query.Encode(), nil, nil, &data); err != nil {
+		return nil, err
+	}
+	entries := make(map[string]Entry, len(data.Entries))
+	for _, e := range data.Entries {
+		value := string(e.Value)
+		if e.Type != "int64" {
+			if err := json.Unmarshal(e.Value, &value); err != nil {
+				return nil, fmt.Errorf("can't decode the value of %s: %w", e.Key, err)
+			}
+		}
+		entries[e.Key] = Entry{e.Type, value}
+	}
+	return entries, nil
+}
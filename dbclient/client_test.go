@@ -0,0 +1,260 @@
+package dbclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeDb serves a map of values the way the db service does, failing the first requests if asked to.
+type fakeDb struct {
+	values   map[string]json.RawMessage
+	failures atomic.Int32
+}
+
+func (f *fakeDb) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if f.failures.Add(-1) >= 0 {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(rw).Encode(Error{Code: "unavailable", Message: "database is closed"})
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/db/")
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		var keys []string
+		for k := range f.values {
+			if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+				keys = append(keys, k)
+			}
+		}
+		json.NewEncoder(rw).Encode(map[string][]string{"keys": keys})
+	case r.Method == http.MethodGet:
+		value, ok := f.values[key]
+		if !ok {
+			rw.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(rw).Encode(Error{Code: "not_found", Message: "record does not exist"})
+			return
+		}
+		json.NewEncoder(rw).Encode(map[string]interface{}{"key": key, "value": value})
+	case r.Method == http.MethodPut:
+		var body struct {
+			Value json.RawMessage `json:"value"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.values[key] = body.Value
+		rw.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		delete(f.values, key)
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestClient(t *testing.T) {
+	fake := &fakeDb{values: make(map[string]json.RawMessage)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	c := New(server.URL, WithRetries(2, time.Millisecond))
+	ctx := context.Background()
+
+	if err := c.Put(ctx, "a/1", "text"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PutInt64(ctx, "a/2", 42); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := c.Get(ctx, "a/1"); err != nil || value != "text" {
+		t.Errorf("Bad value [%s]: %v", value, err)
+	}
+	if n, err := c.GetInt64(ctx, "a/2"); err != nil || n != 42 {
+		t.Errorf("Bad value [%d]: %v", n, err)
+	}
+	if keys, err := c.Scan(ctx, "a/"); err != nil || len(keys) != 2 {
+		t.Errorf("Unexpected keys %v: %v", keys, err)
+	}
+	if err := c.Delete(ctx, "a/1"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := c.Get(ctx, "a/1")
+	var e *Error
+	if !errors.Is(err, ErrNotFound) || !errors.As(err, &e) || e.Status != http.StatusNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	// Two retries outlast two failures, but not three
+	fake.failures.Store(2)
+	if value, err := c.GetInt64(ctx, "a/2"); err != nil || value != 42 {
+		t.Errorf("Expected the request to be retried, got %d: %v", value, err)
+	}
+	fake.failures.Store(3)
+	if _, err := c.GetInt64(ctx, "a/2"); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable, got %v", err)
+	}
+}
+
+func TestResponseError(t *testing.T) {
+	rw := httptest.NewRecorder()
+	rw.WriteHeader(http.StatusBadGateway)
+	rw.WriteString("all servers are out of reach\n")
+	err := responseError(rw.Result())
+	expected := &Error{Status: http.StatusBadGateway, Code: "http_502", Message: "all servers are out of reach"}
+	if !reflect.DeepEqual(err, expected) {
+		t.Errorf("Expected %v, got %v", expected, err)
+	}
+	if !retryable(err, true) || retryable(err, false) {
+		t.Error("Expected a 502 to be retried only for idempotent requests")
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	refused := &url.Error{Op: "Post", URL: "http://db:8100/db/_batch", Err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}}
+	reset := &url.Error{Op: "Post", URL: "http://db:8100/db/_batch", Err: &net.OpError{Op: "read", Err: syscall.ECONNRESET}}
+	closed := &url.Error{Op: "Post", URL: "http://db:8100/db/_batch", Err: io.EOF}
+	unavailable := &Error{Status: http.StatusServiceUnavailable, Code: "unavailable"}
+	for _, c := range []struct {
+		err                  error
+		idempotent, repeated bool
+	}{
+		{refused, false, true},
+		{reset, false, false},
+		{closed, false, false},
+		{unavailable, false, true},
+		{reset, true, true},
+		{closed, true, true},
+		{context.Canceled, true, false},
+	} {
+		if retryable(c.err, c.idempotent) != c.repeated {
+			t.Errorf("Expected retryable(%v, %t) to be %t", c.err, c.idempotent, c.repeated)
+		}
+	}
+	if idempotent(http.MethodPost, nil) || !idempotent(http.MethodPut, nil) || idempotent(http.MethodPut, ifVersion(`"1"`)) {
+		t.Error("Unexpected idempotent requests")
+	}
+}
+
+func TestPutIfVersion(t *testing.T) {
+	version := `"1"`
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			rw.Header().Set("etag", version)
+			json.NewEncoder(rw).Encode(map[string]string{"key": "k", "value": "v"})
+			return
+		}
+		if r.Header.Get("if-match") != version {
+			rw.WriteHeader(http.StatusPreconditionFailed)
+			json.NewEncoder(rw).Encode(Error{Code: "precondition_failed", Message: "condition failed"})
+			return
+		}
+		version = `"2"`
+		rw.Header().Set("etag", version)
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	c := New(server.URL)
+	ctx := context.Background()
+
+	_, v, err := c.GetVersion(ctx, "k")
+	if err != nil || v != `"1"` {
+		t.Fatalf("Bad version %s: %v", v, err)
+	}
+	if v, err = c.PutIfVersion(ctx, "k", "new", v); err != nil || v != `"2"` {
+		t.Errorf("Bad new version %s: %v", v, err)
+	}
+	if _, err := c.PutIfVersion(ctx, "k", "new", `"1"`); !errors.Is(err, ErrConditionFailed) {
+		t.Errorf("Expected ErrConditionFailed, got %v", err)
+	}
+}
+
+func TestWait(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("wait") != "1s" {
+			t.Errorf("Unexpected wait %s", r.URL.Query().Get("wait"))
+		}
+		if after := r.URL.Query().Get("after"); after != "" {
+			rw.Header().Set("etag", after)
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		rw.Header().Set("etag", `"3"`)
+		json.NewEncoder(rw).Encode(map[string]string{"key": "k", "value": "v"})
+	}))
+	defer server.Close()
+	c := New(server.URL)
+	ctx := context.Background()
+
+	value, version, err := c.Wait(ctx, "k", "", time.Second)
+	if err != nil || value != "v" || version != `"3"` {
+		t.Errorf("Unexpected value %s of version %s: %v", value, version, err)
+	}
+	if _, version, err := c.Wait(ctx, "k", `"3"`, time.Second); !errors.Is(err, ErrNotChanged) || version != `"3"` {
+		t.Errorf("Expected ErrNotChanged with the same version, got %s: %v", version, err)
+	}
+}
+
+func TestIncrBy(t *testing.T) {
+	var (
+		value   *int64
+		version int
+		// Changes the value before the next put, like another client
+		interfere = true
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		etag := fmt.Sprintf(`"%d"`, version)
+		switch {
+		case r.Method == http.MethodGet && value == nil:
+			rw.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(rw).Encode(Error{Code: "not_found", Message: "record does not exist"})
+		case r.Method == http.MethodGet:
+			rw.Header().Set("etag", etag)
+			json.NewEncoder(rw).Encode(map[string]interface{}{"key": "n", "value": *value})
+		default:
+			if interfere {
+				n := int64(10)
+				value, version, interfere = &n, version+1, false
+			}
+			if (value == nil && r.Header.Get("if-none-match") != "*") || (value != nil && r.Header.Get("if-match") != fmt.Sprintf(`"%d"`, version)) {
+				rw.WriteHeader(http.StatusPreconditionFailed)
+				json.NewEncoder(rw).Encode(Error{Code: "precondition_failed", Message: "condition failed"})
+				return
+			}
+			var body struct {
+				Value int64 `json:"value"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			value, version = &body.Value, version+1
+			rw.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+	c := New(server.URL)
+	ctx := context.Background()
+
+	// The first attempt finds no value, but the value is 10 by the time of the put
+	if n, err := c.IncrBy(ctx, "n", 2); err != nil || n != 12 {
+		t.Errorf("Expected 12, got %d: %v", n, err)
+	}
+	if n, err := c.IncrBy(ctx, "n", -5); err != nil || n != 7 || *value != 7 {
+		t.Errorf("Expected 7, got %d: %v", n, err)
+	}
+
+	// A result which doesn't fit int64 isn't put, as the local database doesn't put it
+	*value = math.MaxInt64 - 1
+	if _, err := c.IncrBy(ctx, "n", 2); !errors.Is(err, ErrOverflow) || *value != math.MaxInt64-1 {
+		t.Errorf("Expected ErrOverflow and the value to stay, got %v and %d", err, *value)
+	}
+	if err := error(&Error{Status: http.StatusUnprocessableEntity, Code: "overflow"}); !errors.Is(err, ErrOverflow) {
+		t.Errorf("Expected the overflow response of the service to be ErrOverflow")
+	}
+}
@@ -0,0 +1,91 @@
+package dbclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+var (
+	ErrNotFound     = errors.New("record does not exist")
+	ErrWrongType    = errors.New("wrong type of value")
+	ErrInvalidValue = errors.New("invalid value")
+	ErrUnavailable  = errors.New("database is unavailable")
+	// The token given with WithToken is missing or unknown, or it isn't allowed to access the key
+	ErrUnauthorized = errors.New("access is denied")
+	// The value was changed since the version given to PutIfVersion was read
+	ErrConditionFailed = errors.New("version does not match")
+	// The value didn't change during Wait
+	ErrNotChanged = errors.New("value did not change")
+	// The result of IncrBy doesn't fit int64
+	ErrOverflow = errors.New("increment or decrement would overflow")
+)
+
+// The errors matched by the codes of the service
+var codeErrors = map[string]error{
+	"not_found":     ErrNotFound,
+	"wrong_type":    ErrWrongType,
+	"invalid_value": ErrInvalidValue,
+	"unavailable":   ErrUnavailable,
+	"overflow":      ErrOverflow,
+
+	"precondition_failed": ErrConditionFailed,
+	"unauthorized":        ErrUnauthorized,
+	"forbidden":           ErrUnauthorized,
+}
+
+// Error is an error response of the service. Use errors.Is with ErrNotFound and others to tell them apart.
+type Error struct {
+	// HTTP status of the response
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("db service: %s (%d %s)", e.Message, e.Status, e.Code)
+}
+
+func (e *Error) Is(target error) bool {
+	return codeErrors[e.Code] == target
+}
+
+// retryable tells whether a request failed with err can succeed if it is sent again.
+// Requests which aren't idempotent are retried only if they can't have been applied.
+func retryable(err error, idempotentRequest bool) bool {
+	var e *Error
+	if errors.As(err, &e) {
+		switch e.Status {
+		case http.StatusServiceUnavailable:
+			// Sent by the service when it can't apply requests
+			return true
+		case http.StatusBadGateway, http.StatusGatewayTimeout:
+			// A proxy could have lost the response of an applied request
+			return idempotentRequest
+		}
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	// Connections refused while the service restarts, the request isn't sent
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	// Connections reset or closed after the request could have been received
+	var netErr net.Error
+	return idempotentRequest && (errors.As(err, &netErr) || errors.Is(err, net.ErrClosed))
+}
+
+// idempotent tells whether sending the request twice has the same effect as sending it once.
+// Conditional requests aren't: a repeated one fails if the first one succeeded.
+func idempotent(method string, header http.Header) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return header.Get("if-match") == "" && header.Get("if-none-match") == ""
+	}
+	return false
+}
@@ -1,6 +1,8 @@
 package httptools
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -9,28 +11,53 @@ import (
 
 type Server interface {
 	Start()
+	// Shutdown stops accepting connections and waits for the active requests to finish until ctx is done.
+	Shutdown(ctx context.Context) error
 }
 
 type server struct {
 	httpServer *http.Server
+	// Serve HTTPS with these if set
+	certFile, keyFile string
 }
 
 func (s server) Start() {
 	go func() {
 		log.Println("Staring the HTTP server...")
-		err := s.httpServer.ListenAndServe()
+		var err error
+		if s.certFile != "" {
+			err = s.httpServer.ListenAndServeTLS(s.certFile, s.keyFile)
+		} else {
+			err = s.httpServer.ListenAndServe()
+		}
+		if errors.Is(err, http.ErrServerClosed) {
+			return
+		}
 		log.Fatalf("HTTP server finished: %s. Finishing the process.", err)
 	}()
 }
 
+func (s server) Shutdown(ctx context.Context) error {
+	log.Println("Draining the HTTP server...")
+	return s.httpServer.Shutdown(ctx)
+}
+
 func CreateServer(port int, handler http.Handler) Server {
+	return CreateServerAt(fmt.Sprintf(":%d", port), handler, "", "")
+}
+
+// CreateServerAt creates a server listening on addr, such as "127.0.0.1:8100".
+// If certFile and keyFile are given, it serves HTTPS with that certificate.
+func CreateServerAt(addr string, handler http.Handler, certFile, keyFile string) Server {
 	return server{
 		httpServer: &http.Server{
-			Addr:           fmt.Sprintf(":%d", port),
+			Addr:           addr,
 			Handler:        handler,
 			ReadTimeout:    10 * time.Second,
 			WriteTimeout:   10 * time.Second,
 			MaxHeaderBytes: 1 << 20,
 		},
+		certFile: certFile,
+		keyFile:  keyFile,
 	}
 }
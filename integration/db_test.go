@@ -0,0 +1,58 @@
+package integration
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/dbclient"
+	"github.com/stretchr/testify/assert"
+)
+
+const dbAddress = "http://db:8100"
+
+func TestDb(t *testing.T) {
+	if _, exists := os.LookupEnv("INTEGRATION_TEST"); !exists {
+		t.Skip("Integration test is not enabled")
+	}
+	db := dbclient.New(dbAddress)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Written by every server at startup
+	value, err := db.Get(ctx, team)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, value)
+
+	assert.NoError(t, db.Put(ctx, "integration/string", "value"))
+	assert.NoError(t, db.PutInt64(ctx, "integration/int64", 42))
+	value, err = db.Get(ctx, "integration/string")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+	n, err := db.GetInt64(ctx, "integration/int64")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(42), n)
+
+	_, err = db.GetInt64(ctx, "integration/string")
+	assert.ErrorIs(t, err, dbclient.ErrWrongType)
+
+	keys, err := db.Scan(ctx, "integration/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"integration/int64", "integration/string"}, keys)
+
+	entries, err := db.MGet(ctx, "integration/string", "integration/int64", "integration/missing")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]dbclient.Entry{
+		"integration/string": {Type: "string", Value: "value"},
+		"integration/int64":  {Type: "int64", Value: "42"},
+	}, entries)
+
+	errs, err := db.Batch(ctx, dbclient.DeleteOp("integration/int64"), dbclient.DeleteOp("integration/missing"))
+	assert.NoError(t, err)
+	assert.NoError(t, errs[0])
+	assert.ErrorIs(t, errs[1], dbclient.ErrNotFound)
+	assert.NoError(t, db.Delete(ctx, "integration/string"))
+	_, err = db.Get(ctx, "integration/string")
+	assert.ErrorIs(t, err, dbclient.ErrNotFound)
+}
@@ -1,15 +1,61 @@
 package signal
 
 import (
+	"context"
 	"log"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 )
 
+// ShutdownTimeout limits the time all shutdown hooks can take together.
+var ShutdownTimeout = 30 * time.Second
+
+type hook struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+var (
+	hooksMu sync.Mutex
+	hooks   []hook
+)
+
+// OnShutdown registers a hook run by WaitForTerminationSignal once the signal arrives.
+// Hooks run one after another in the order they were registered, so a server can be drained
+// before the resources it uses are released. ctx expires after ShutdownTimeout.
+func OnShutdown(name string, run func(ctx context.Context) error) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	hooks = append(hooks, hook{name, run})
+}
+
+// WaitForTerminationSignal blocks until SIGINT or SIGTERM and then runs the shutdown hooks.
+// Another signal received while they run terminates the process immediately.
 func WaitForTerminationSignal() {
-	intChannel := make(chan os.Signal)
+	intChannel := make(chan os.Signal, 1)
 	signal.Notify(intChannel, syscall.SIGINT, syscall.SIGTERM)
 	<-intChannel
 	log.Println("Shutting down...")
+	go func() {
+		<-intChannel
+		log.Println("Forced to exit")
+		os.Exit(1)
+	}()
+	runHooks()
+}
+
+func runHooks() {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	for _, h := range hooks {
+		if err := h.run(ctx); err != nil {
+			log.Printf("Shutdown of %s failed: %s", h.name, err)
+		}
+	}
+	hooks = nil
 }
@@ -0,0 +1,27 @@
+package signal
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRunHooks(t *testing.T) {
+	var order []string
+	OnShutdown("first", func(ctx context.Context) error {
+		order = append(order, "first")
+		return errors.New("failed")
+	})
+	OnShutdown("second", func(ctx context.Context) error {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("Expected a deadline for the hooks")
+		}
+		order = append(order, "second")
+		return nil
+	})
+	runHooks()
+	if expected := []string{"first", "second"}; !reflect.DeepEqual(order, expected) {
+		t.Errorf("Expected the hooks to run in order %v, got %v", expected, order)
+	}
+}